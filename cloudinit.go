@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// cloudInitDefault is used when no "cloud_init" template is configured. The
+// password is always set as it's needed for sudo.
+const cloudInitDefault = `#cloud-config
+ssh_pwauth: {{if .SSHKeysOnly}}False{{else}}True{{end}}
+manage_etc_hosts: True
+users:
+ - name: {{quote .Username}}
+   groups: sudo
+   plain_text_passwd: {{quote .Password}}
+   lock_passwd: False
+   shell: /bin/bash
+{{- if .SSHKey}}
+   ssh_authorized_keys:
+    - {{quote .SSHKey}}
+{{- end}}
+`
+
+// cloudInitData holds the session variables available to the template.
+type cloudInitData struct {
+	ContainerName string
+	Environment   string
+	Expiry        int64
+	Password      string
+	SessionID     string
+	SSHKey        string
+	SSHKeysOnly   bool
+	Username      string
+}
+
+// cloudInitFuncs lets templates safely embed arbitrary strings, JSON strings
+// being valid YAML scalars.
+var cloudInitFuncs = template.FuncMap{
+	"quote": func(value string) (string, error) {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+
+		return string(data), nil
+	},
+}
+
+// cloudInitLoad parses the configured cloud-init template.
+func cloudInitLoad() (*template.Template, error) {
+	content := cloudInitDefault
+	if config.CloudInit != "" {
+		data, err := ioutil.ReadFile(config.CloudInit)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read the cloud_init template: %s", err)
+		}
+
+		content = string(data)
+	}
+
+	tpl, err := template.New("cloud_init").Funcs(cloudInitFuncs).Parse(content)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cloud_init template: %s", err)
+	}
+
+	// Catch mistakes now rather than when starting sessions
+	sample := cloudInitData{
+		ContainerName: "tryit-sample",
+		Environment:   "default",
+		Password:      "password",
+		SessionID:     "00000000-0000-0000-0000-000000000000",
+		SSHKey:        "ssh-ed25519 AAAA",
+		Username:      "sample",
+	}
+
+	_, err = cloudInitRender(tpl, sample)
+	if err != nil {
+		return nil, err
+	}
+
+	return tpl, nil
+}
+
+// cloudInitRender renders the user-data for a session, making sure the
+// result is valid YAML.
+func cloudInitRender(tpl *template.Template, data cloudInitData) (string, error) {
+	var buf bytes.Buffer
+	err := tpl.Execute(&buf, data)
+	if err != nil {
+		return "", fmt.Errorf("Unable to render the cloud_init template: %s", err)
+	}
+
+	parsed := map[string]interface{}{}
+	err = yaml.Unmarshal(buf.Bytes(), &parsed)
+	if err != nil {
+		return "", fmt.Errorf("The cloud_init template didn't render to valid YAML: %s", err)
+	}
+
+	return buf.String(), nil
+}
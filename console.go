@@ -0,0 +1,508 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lxc/lxd/shared/api"
+)
+
+var consoleTermValid = regexp.MustCompile(`^[a-zA-Z0-9._+-]{1,64}$`)
+
+type consoleConfig struct {
+	Cwd         string            `yaml:"cwd"`
+	Environment map[string]string `yaml:"environment"`
+	GID         uint32            `yaml:"gid"`
+	UID         uint32            `yaml:"uid"`
+	User        string            `yaml:"user"`
+}
+
+func consoleValidate(console consoleConfig) error {
+	if console.Cwd != "" && console.Cwd[0] != '/' {
+		return fmt.Errorf("Invalid console working directory: %s", console.Cwd)
+	}
+
+	if console.User == "" && (console.UID != 0 || console.GID != 0) {
+		return fmt.Errorf("The console uid and gid require a console user")
+	}
+
+	// Console-only sessions don't get credentials for that user
+	if console.User == "session" && config.ServerConsoleOnly {
+		return fmt.Errorf("The session console user can't be used with server_console_only")
+	}
+
+	return nil
+}
+
+// consolePasswd parses the uid, gid and home directory out of a passwd entry.
+func consolePasswd(entry string) (uint32, uint32, string, error) {
+	fields := strings.Split(strings.TrimSpace(entry), ":")
+	if len(fields) != 7 {
+		return 0, 0, "", fmt.Errorf("Invalid passwd entry: %s", entry)
+	}
+
+	uid, err := strconv.ParseUint(fields[2], 10, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("Invalid uid in passwd entry: %s", entry)
+	}
+
+	gid, err := strconv.ParseUint(fields[3], 10, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("Invalid gid in passwd entry: %s", entry)
+	}
+
+	return uint32(uid), uint32(gid), fields[5], nil
+}
+
+// consoleUser returns the name, uid, gid and home directory of the console
+// user of the environment. The user "session" is the one created by
+// cloud-init for the session, named containerUsername. Users without a
+// configured uid and gid are looked up in the container.
+func consoleUser(env environment, containerName string, containerUsername string) (string, uint32, uint32, string, error) {
+	console := consoleConfig{}
+	if env.Console != nil {
+		console = *env.Console
+	}
+
+	user := console.User
+	if user == "" {
+		return "root", 0, 0, "/root", nil
+	} else if user == "session" {
+		user = containerUsername
+	}
+
+	if user == "root" {
+		return user, console.UID, console.GID, "/root", nil
+	}
+
+	if console.UID != 0 || console.GID != 0 {
+		return user, console.UID, console.GID, fmt.Sprintf("/home/%s", user), nil
+	}
+
+	status, output, err := lxdExec(lxdDaemon, containerName, []string{"getent", "passwd", user}, nil, 10*time.Second)
+	if err != nil || status != 0 {
+		return "", 0, 0, "", fmt.Errorf("Unable to find console user %s", user)
+	}
+
+	uid, gid, home, err := consolePasswd(output)
+	if err != nil {
+		return "", 0, 0, "", err
+	}
+
+	return user, uid, gid, home, nil
+}
+
+// consoleExecPost returns the exec request for a console session in the
+// environment.
+func consoleExecPost(env environment, containerName string, containerUsername string, term string) (api.ContainerExecPost, error) {
+	console := consoleConfig{}
+	if env.Console != nil {
+		console = *env.Console
+	}
+
+	user, uid, gid, home, err := consoleUser(env, containerName, containerUsername)
+	if err != nil {
+		return api.ContainerExecPost{}, err
+	}
+
+	cwd := console.Cwd
+	if cwd == "" {
+		cwd = home
+	}
+
+	if !consoleTermValid.MatchString(term) {
+		term = "xterm"
+	}
+
+	environment := make(map[string]string)
+	for key, value := range console.Environment {
+		environment[key] = value
+	}
+
+	environment["USER"] = user
+	environment["HOME"] = home
+	environment["TERM"] = term
+
+	return api.ContainerExecPost{
+		Command:     env.Command,
+		WaitForWS:   true,
+		Interactive: true,
+		Environment: environment,
+		User:        uid,
+		Group:       gid,
+		Cwd:         cwd,
+	}, nil
+}
+
+// consoleSession tracks the activity of a session across all its consoles,
+// web and SSH alike, so that the session is only considered idle when none
+// of them is in use. Only sessions which had a console on this server are
+// tracked, the last activity being shared with the other servers through the
+// database.
+type consoleSession struct {
+	last     time.Time
+	recorded time.Time
+	warned   bool
+	consoles map[int]func(msg string) error
+}
+
+// consoleRecordInterval is how often the activity gets recorded in the
+// database while a console is in use.
+const consoleRecordInterval = 10 * time.Second
+
+var consoleLock sync.Mutex
+var consoleSessions = map[int64]*consoleSession{}
+var consoleNext int
+
+// consoleGetSession must be called with consoleLock held.
+func consoleGetSession(sessionId int64) *consoleSession {
+	session, ok := consoleSessions[sessionId]
+	if !ok {
+		session = &consoleSession{last: time.Now(), consoles: map[int]func(msg string) error{}}
+		consoleSessions[sessionId] = session
+	}
+
+	return session
+}
+
+// consoleTouch records some console activity for the session.
+func consoleTouch(sessionId int64) {
+	now := time.Now()
+
+	consoleLock.Lock()
+	session := consoleGetSession(sessionId)
+	idle := now.Sub(session.last)
+	warned := session.warned
+	session.last = now
+	session.warned = false
+
+	record := warned || now.Sub(session.recorded) >= consoleRecordInterval
+	if record {
+		session.recorded = now
+	}
+	consoleLock.Unlock()
+
+	if record {
+		err := db.SetConsoleActivity(sessionId, now.Unix())
+		if err != nil {
+			fmt.Printf("Failed to record the console activity of session %d: %s\n", sessionId, err)
+		}
+	}
+
+	// The user came back after being warned
+	if warned {
+		consoleRecordIdle(sessionId, idle)
+	}
+}
+
+// consoleAttach registers a console of the session, through which idle
+// warnings get printed. The returned function unregisters it.
+func consoleAttach(sessionId int64, warn func(msg string) error) func() {
+	consoleTouch(sessionId)
+
+	consoleLock.Lock()
+	id := consoleNext
+	consoleNext++
+	consoleGetSession(sessionId).consoles[id] = warn
+	consoleLock.Unlock()
+
+	return func() {
+		consoleLock.Lock()
+		session, ok := consoleSessions[sessionId]
+		if ok {
+			delete(session.consoles, id)
+		}
+		consoleLock.Unlock()
+	}
+}
+
+// consoleRecordIdle records the idle periods which got the user warned.
+func consoleRecordIdle(sessionId int64, idle time.Duration) {
+	err := db.AddIdleTime(sessionId, int64(idle.Seconds()))
+	if err != nil {
+		fmt.Printf("Failed to record the idle time of session %d: %s\n", sessionId, err)
+	}
+}
+
+// consoleIdleRun warns the users of sessions which have been idle for
+// "quota_idle" seconds through their consoles and terminates the sessions
+// which stay idle for another "quota_idle_grace" seconds.
+func consoleIdleRun() {
+	for {
+		time.Sleep(consoleRecordInterval)
+
+		err := consoleIdleCheck()
+		if err != nil {
+			fmt.Printf("Unable to check for idle sessions: %s\n", err)
+		}
+	}
+}
+
+func consoleIdleCheck() error {
+	if config.QuotaIdle == 0 {
+		consoleLock.Lock()
+		consoleSessions = map[int64]*consoleSession{}
+		consoleLock.Unlock()
+
+		return nil
+	}
+
+	threshold := time.Duration(config.QuotaIdle) * time.Second
+	grace := time.Duration(config.QuotaIdleGrace) * time.Second
+	msg := fmt.Sprintf("\r\n\033[1;33m*** This session has been idle for %s and will be terminated in %s unless there's some activity ***\033[0m\r\n", threshold, grace)
+
+	consoleLock.Lock()
+	sessionIds := []int64{}
+	for sessionId := range consoleSessions {
+		sessionIds = append(sessionIds, sessionId)
+	}
+	consoleLock.Unlock()
+
+	for _, sessionId := range sessionIds {
+		containerName, activity, err := db.GetConsoleActivity(sessionId)
+		if err != nil {
+			return err
+		}
+
+		warnings := []func(msg string) error{}
+		reclaim := false
+
+		consoleLock.Lock()
+		session, ok := consoleSessions[sessionId]
+		if !ok {
+			consoleLock.Unlock()
+			continue
+		}
+
+		// Forget about the sessions which are gone
+		if activity == -1 {
+			delete(consoleSessions, sessionId)
+			consoleLock.Unlock()
+			continue
+		}
+
+		// The session may be in use through another server
+		if time.Unix(activity, 0).After(session.last) {
+			session.last = time.Unix(activity, 0)
+			session.recorded = session.last
+			session.warned = false
+		}
+
+		idle := time.Since(session.last)
+		if !session.warned && idle >= threshold {
+			session.warned = true
+			for _, warn := range session.consoles {
+				warnings = append(warnings, warn)
+			}
+		} else if session.warned && idle >= threshold+grace {
+			reclaim = true
+			delete(consoleSessions, sessionId)
+		}
+		consoleLock.Unlock()
+
+		for _, warn := range warnings {
+			warn(msg)
+		}
+
+		if !reclaim {
+			continue
+		}
+
+		// Another server may have reclaimed it already
+		expired, err := db.ExpireActive(sessionId)
+		if err != nil {
+			return err
+		}
+
+		if !expired {
+			continue
+		}
+
+		consoleRecordIdle(sessionId, idle)
+
+		fmt.Printf("Reclaiming idle session %s\n", containerName)
+		lxdForceDelete(lxdDaemon, containerName)
+		proxyForget(containerName)
+	}
+
+	return nil
+}
+
+// consoleInput records the activity of a console's input, also auditing it
+// when given an auditor.
+type consoleInput struct {
+	io.ReadCloser
+	sessionId int64
+
+	lock    sync.Mutex
+	auditor *consoleAuditor
+}
+
+func (c *consoleInput) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if n > 0 {
+		consoleTouch(c.sessionId)
+
+		if c.auditor != nil {
+			c.lock.Lock()
+			c.auditor.write(p[:n])
+			c.lock.Unlock()
+		}
+	}
+
+	return n, err
+}
+
+// flush records what's left in the auditor, the input may still be read
+// from another goroutine.
+func (c *consoleInput) flush() {
+	if c.auditor == nil {
+		return
+	}
+
+	c.lock.Lock()
+	c.auditor.flush()
+	c.lock.Unlock()
+}
+
+// consoleOutput records the activity of a console's output.
+type consoleOutput struct {
+	io.WriteCloser
+	sessionId int64
+}
+
+func (c *consoleOutput) Write(p []byte) (int, error) {
+	consoleTouch(c.sessionId)
+	return c.WriteCloser.Write(p)
+}
+
+// consoleAuditor records what's typed into a console, either as is
+// ("keystrokes") or as reconstructed command lines ("commands"). It's only
+// meant to be used by a single goroutine.
+type consoleAuditor struct {
+	sessionId int64
+	mode      string
+
+	buf    []byte
+	escape int
+}
+
+func (a *consoleAuditor) write(payload []byte) {
+	if a.mode == "keystrokes" {
+		a.buf = append(a.buf, payload...)
+		if strings.ContainsAny(string(payload), "\r\n") || len(a.buf) >= 1024 {
+			a.flush()
+		}
+
+		return
+	}
+
+	for _, c := range payload {
+		// Skip escape sequences (cursor keys and the like)
+		if a.escape == 1 {
+			a.escape = 0
+			if c == '[' || c == 'O' {
+				a.escape = 2
+			}
+
+			continue
+		} else if a.escape == 2 {
+			if c >= 0x40 && c <= 0x7e {
+				a.escape = 0
+			}
+
+			continue
+		}
+
+		switch {
+		case c == 0x1b:
+			a.escape = 1
+		case c == '\r' || c == '\n':
+			a.flush()
+		case c == 0x7f || c == '\b':
+			_, size := utf8.DecodeLastRune(a.buf)
+			a.buf = a.buf[:len(a.buf)-size]
+		case c == 0x03 || c == 0x15:
+			// Ctrl-C and Ctrl-U discard the line
+			a.buf = a.buf[:0]
+		case c < 0x20 && c != '\t':
+			continue
+		default:
+			if len(a.buf) < 4096 {
+				a.buf = append(a.buf, c)
+			}
+		}
+	}
+}
+
+func (a *consoleAuditor) flush() {
+	data := string(a.buf)
+	a.buf = a.buf[:0]
+
+	if a.mode == "commands" {
+		data = strings.TrimSpace(data)
+	}
+
+	if data == "" {
+		return
+	}
+
+	err := db.RecordConsoleInput(a.sessionId, data)
+	if err != nil {
+		fmt.Printf("Failed to record console input: %s\n", err)
+	}
+}
+
+func restAdminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if !restAdminAuth(w, r) {
+		return
+	}
+
+	// Get the id
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "Missing session id", 400)
+		return
+	}
+
+	sessionId, _, _, _, _, err := db.GetContainer(id, false)
+	if err != nil || sessionId == -1 {
+		http.Error(w, "Session not found", 404)
+		return
+	}
+
+	input, err := db.GetConsoleInput(id)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	body := []map[string]interface{}{}
+	for _, entry := range input {
+		body = append(body, map[string]interface{}{
+			"date":  entry[0],
+			"input": entry[1],
+		})
+	}
+
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConsolePasswd(t *testing.T) {
+	tests := []struct {
+		entry string
+		uid   uint32
+		gid   uint32
+		home  string
+		valid bool
+	}{
+		{"ubuntu:x:1000:1000:Ubuntu:/home/ubuntu:/bin/bash\n", 1000, 1000, "/home/ubuntu", true},
+		{"builder:x:1001:100::/srv/builder:/bin/sh", 1001, 100, "/srv/builder", true},
+		{"", 0, 0, "", false},
+		{"ubuntu:x:1000:1000", 0, 0, "", false},
+		{"ubuntu:x:abc:1000:Ubuntu:/home/ubuntu:/bin/bash", 0, 0, "", false},
+		{"ubuntu:x:1000:-1:Ubuntu:/home/ubuntu:/bin/bash", 0, 0, "", false},
+	}
+
+	for _, test := range tests {
+		uid, gid, home, err := consolePasswd(test.entry)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("consolePasswd(%q) didn't fail", test.entry)
+			}
+
+			continue
+		}
+
+		if err != nil || uid != test.uid || gid != test.gid || home != test.home {
+			t.Errorf("consolePasswd(%q) = %d, %d, %q, %v", test.entry, uid, gid, home, err)
+		}
+	}
+}
+
+func TestConsoleIdle(t *testing.T) {
+	defer dbTestGlobal(t)()
+
+	daemon := &lxdTestServer{}
+	lxdDaemon = daemon
+	defer func() { lxdDaemon = nil }()
+
+	config = serverConfig{QuotaIdle: 60, QuotaIdleGrace: 60}
+	defer func() { consoleSessions = map[int64]*consoleSession{} }()
+
+	now := time.Now().Unix()
+	first := dbTestSession(t, db, "session-1", "10.1.1.1", now)
+	second := dbTestSession(t, db, "session-2", "10.1.1.1", now)
+	third := dbTestSession(t, db, "session-3", "10.1.1.1", now)
+
+	// Sessions without a console on this server are left alone
+	err := consoleIdleCheck()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(consoleSessions) != 0 {
+		t.Fatalf("Tracking %d sessions, want 0", len(consoleSessions))
+	}
+
+	// Two consoles of the same session
+	warnings := map[string]int{}
+	for _, name := range []string{"web", "ssh"} {
+		name := name
+		detach := consoleAttach(first, func(msg string) error {
+			warnings[name]++
+			return nil
+		})
+		defer detach()
+	}
+
+	// A console which got closed
+	consoleAttach(third, func(msg string) error { return nil })()
+
+	idle := func(sessionId int64, duration time.Duration) {
+		consoleLock.Lock()
+		consoleSessions[sessionId].last = time.Now().Add(-duration)
+		consoleLock.Unlock()
+
+		err := db.SetConsoleActivity(sessionId, time.Now().Add(-duration).Unix())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		prepare  func()
+		warnings int
+	}{
+		{"active", func() {}, 0},
+		{"idle", func() { idle(first, 61*time.Second) }, 1},
+		{"still idle", func() {}, 1},
+		{"back", func() { consoleTouch(first) }, 1},
+		{"idle again", func() { idle(first, 90*time.Second) }, 2},
+		{"back through another server", func() { db.SetConsoleActivity(first, time.Now().Unix()) }, 2},
+		{"idle once more", func() { idle(first, 61*time.Second) }, 3},
+	}
+
+	for _, test := range tests {
+		test.prepare()
+
+		err := consoleIdleCheck()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if warnings["web"] != test.warnings || warnings["ssh"] != test.warnings {
+			t.Errorf("%s: got %v warnings, want %d on each console", test.name, warnings, test.warnings)
+		}
+	}
+
+	// Ended sessions are forgotten
+	err = db.Expire(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	consoleTouch(second)
+
+	err = consoleIdleCheck()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, ok := consoleSessions[second]
+	if ok {
+		t.Errorf("Ended session still tracked")
+	}
+
+	// Sessions staying idle past the grace period get reclaimed, whether
+	// their console is still open or not
+	idle(first, 130*time.Second)
+	idle(third, 61*time.Second)
+
+	err = consoleIdleCheck()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idle(third, 130*time.Second)
+
+	err = consoleIdleCheck()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(daemon.deleted, ",") != "tryit-session-1,tryit-session-3" {
+		t.Errorf("Deleted %v, want the first and third sessions", daemon.deleted)
+	}
+
+	for _, sessionId := range []int64{first, third} {
+		_, activity, err := db.GetConsoleActivity(sessionId)
+		if err != nil || activity != -1 {
+			t.Errorf("Reclaimed session %d still active: %d, %v", sessionId, activity, err)
+		}
+
+		_, ok := consoleSessions[sessionId]
+		if ok {
+			t.Errorf("Reclaimed session %d still tracked", sessionId)
+		}
+	}
+
+	// Their expiry doesn't delete the containers again
+	containerExpire(first, "tryit-session-1")
+	if len(daemon.deleted) != 2 {
+		t.Errorf("Expiring a reclaimed session deleted %v", daemon.deleted)
+	}
+}
+
+func TestConsoleInputAudit(t *testing.T) {
+	defer dbTestGlobal(t)()
+
+	config = serverConfig{}
+	defer func() { consoleSessions = map[int64]*consoleSession{} }()
+
+	sessionId := dbTestSession(t, db, "session-1", "10.1.1.1", time.Now().Unix())
+
+	tests := []struct {
+		mode  string
+		input string
+		want  []string
+	}{
+		{"commands", "ls -l\rcat /etc/os-releaze\x7f\x7fse\r\x1b[Aexit", []string{"ls -l", "cat /etc/os-release", "exit"}},
+		{"keystrokes", "ls\r", []string{"ls\r"}},
+		{"", "ls\r", nil},
+	}
+
+	for _, test := range tests {
+		_, err := db.(*dbSqlite).conn.Exec("DELETE FROM console_audit;")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		input := &consoleInput{ReadCloser: ioutil.NopCloser(strings.NewReader(test.input)), sessionId: sessionId}
+		if test.mode != "" {
+			input.auditor = &consoleAuditor{sessionId: sessionId, mode: test.mode}
+		}
+
+		_, err = ioutil.ReadAll(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		input.flush()
+
+		entries, err := db.GetConsoleInput("session-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := []string{}
+		for _, entry := range entries {
+			got = append(got, entry[1].(string))
+		}
+
+		if strings.Join(got, "|") != strings.Join(test.want, "|") {
+			t.Errorf("%q audit of %q = %q, want %q", test.mode, test.input, got, test.want)
+		}
+	}
+}
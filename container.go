@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lxc/lxd/client"
+	lxdconfig "github.com/lxc/lxd/lxc/config"
+	"github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/api"
+)
+
+// containerCreate creates and starts a new container from the environment's
+// container or image, returning its IP address. The container is deleted if
+// anything goes wrong once it's been created.
+func containerCreate(env environment, containerName string, session cloudInitData) (string, error) {
+	// Config
+	ctConfig := map[string]string{}
+
+	ctConfig["security.nesting"] = "true"
+	limitsConfig(ctConfig)
+
+	if !config.ServerConsoleOnly {
+		session.ContainerName = containerName
+		session.Environment = env.Name
+		session.SSHKeysOnly = config.ServerSSHKeysOnly
+
+		userData, err := cloudInitRender(config.cloudInitTemplate, session)
+		if err != nil {
+			return "", err
+		}
+
+		ctConfig["user.user-data"] = userData
+	}
+
+	var err error
+	var rop lxd.RemoteOperation
+	if env.Container != "" {
+		args := lxd.ContainerCopyArgs{
+			Name:          containerName,
+			ContainerOnly: true,
+		}
+
+		source, _, err := lxdDaemon.GetContainer(env.Container)
+		if err != nil {
+			return "", err
+		}
+
+		source.Config = ctConfig
+		source.Profiles = env.Profiles
+
+		rop, err = lxdDaemon.CopyContainer(lxdDaemon, *source, &args)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		defaultConfig := lxdconfig.DefaultConfig
+
+		remote, fingerprint, err := defaultConfig.ParseRemote(env.Image)
+		if err != nil {
+			return "", err
+		}
+
+		var d lxd.ImageServer
+
+		if remote == "local" {
+			d = lxdDaemon
+		} else {
+			d, err = defaultConfig.GetImageServer(remote)
+			if err != nil {
+				return "", err
+			}
+		}
+
+		if fingerprint == "" {
+			fingerprint = "default"
+		}
+
+		alias, _, err := d.GetImageAlias(fingerprint)
+		if err == nil {
+			fingerprint = alias.Target
+		}
+
+		imgInfo, _, err := d.GetImage(fingerprint)
+		if err != nil {
+			return "", err
+		}
+
+		req := api.ContainersPost{
+			Name: containerName,
+		}
+		req.Config = ctConfig
+		req.Profiles = env.Profiles
+
+		rop, err = lxdDaemon.CreateContainerFromImage(d, *imgInfo, req)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = rop.Wait()
+	if err != nil {
+		return "", err
+	}
+
+	// Configure the container devices
+	ct, etag, err := lxdDaemon.GetContainer(containerName)
+	if err != nil {
+		lxdForceDelete(lxdDaemon, containerName)
+		return "", err
+	}
+
+	limitsConfigureDevices(ct)
+	networkConfigureDevices(ct)
+
+	op, err := lxdDaemon.UpdateContainer(containerName, ct.Writable(), etag)
+	if err != nil {
+		lxdForceDelete(lxdDaemon, containerName)
+		return "", err
+	}
+
+	err = op.Wait()
+	if err != nil {
+		lxdForceDelete(lxdDaemon, containerName)
+		return "", err
+	}
+
+	// Start the container
+	req := api.ContainerStatePut{
+		Action:  "start",
+		Timeout: -1,
+	}
+
+	op, err = lxdDaemon.UpdateContainerState(containerName, req, "")
+	if err != nil {
+		lxdForceDelete(lxdDaemon, containerName)
+		return "", err
+	}
+
+	err = op.Wait()
+	if err != nil {
+		lxdForceDelete(lxdDaemon, containerName)
+		return "", err
+	}
+
+	// Get the IP (30s timeout), the proxy needs it even in console-only mode
+	var containerIP string
+	if !config.ServerConsoleOnly || len(config.ServerProxyPorts) > 0 {
+		time.Sleep(2 * time.Second)
+		timeout := 30
+		for timeout != 0 {
+			timeout--
+			ct, _, err := lxdDaemon.GetContainerState(containerName)
+			if err != nil {
+				lxdForceDelete(lxdDaemon, containerName)
+				return "", err
+			}
+
+			for netName, net := range ct.Network {
+				if !shared.StringInSlice(netName, []string{"eth0", "lxcbr0"}) {
+					continue
+				}
+
+				for _, addr := range net.Addresses {
+					if addr.Address == "" {
+						continue
+					}
+
+					if addr.Scope != "global" {
+						continue
+					}
+
+					if config.ServerIPv6Only && addr.Family != "inet6" {
+						continue
+					}
+
+					containerIP = addr.Address
+					break
+				}
+
+				if containerIP != "" {
+					break
+				}
+			}
+
+			if containerIP != "" {
+				break
+			}
+
+			time.Sleep(500 * time.Millisecond)
+		}
+	} else {
+		containerIP = "console-only"
+	}
+
+	return containerIP, nil
+}
+
+// containerExpire deletes the container of a session reaching its expiry.
+// Sessions which already ended (e.g. reclaimed when idle) are left alone as
+// their container name may have been reused since.
+func containerExpire(sessionId int64, containerName string) {
+	expired, err := db.ExpireActive(sessionId)
+	if err != nil {
+		fmt.Printf("Failed to expire session %d: %s\n", sessionId, err)
+		return
+	}
+
+	if !expired {
+		return
+	}
+
+	lxdForceDelete(lxdDaemon, containerName)
+	proxyForget(containerName)
+}
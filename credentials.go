@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"regexp"
+
+	"github.com/dustinkirkland/golang-petname"
+)
+
+// Valid container names, as accepted by LXD
+var containerNameValid = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9-]{0,62}$`)
+
+type containerNameFields struct {
+	Adjective string
+	Adverb    string
+	Name      string
+	Random    string
+}
+
+// containerNameGenerate renders the container name template until it finds
+// a name which isn't used by an active session or an existing container.
+func containerNameGenerate() (string, error) {
+	for i := 0; i < 10; i++ {
+		random, err := randomHex(4)
+		if err != nil {
+			return "", err
+		}
+
+		fields := containerNameFields{
+			Adjective: petname.Adjective(),
+			Adverb:    petname.Adverb(),
+			Name:      petname.Name(),
+			Random:    random,
+		}
+
+		var buf bytes.Buffer
+		err = config.containerNameTemplate.Execute(&buf, fields)
+		if err != nil {
+			return "", err
+		}
+
+		name := buf.String()
+		if !containerNameValid.MatchString(name) {
+			return "", fmt.Errorf("Invalid container name: %s", name)
+		}
+
+		count, err := db.ActiveCountForName(name)
+		if err != nil {
+			return "", err
+		}
+
+		if count > 0 {
+			continue
+		}
+
+		_, _, err = lxdDaemon.GetContainer(name)
+		if err == nil {
+			continue
+		}
+
+		return name, nil
+	}
+
+	return "", fmt.Errorf("Unable to find an unused container name")
+}
+
+// credentialsUsername returns a random lowercase username, short enough to
+// fit the sessions table.
+func credentialsUsername() (string, error) {
+	return randomString("abcdefghijkmnopqrstuvwxyz", 8)
+}
+
+// credentialsPassword returns a random alphanumeric password of the
+// configured length.
+func credentialsPassword() (string, error) {
+	return randomString("abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789", config.PasswordLength)
+}
+
+// credentialsCode returns a short code meant to be typed by people.
+func credentialsCode() (string, error) {
+	return randomString("ABCDEFGHJKLMNPQRSTUVWXYZ23456789", 6)
+}
+
+// credentialsUnusedCode returns a code for which lookup finds nothing (0).
+func credentialsUnusedCode(lookup func(code string) (int64, error)) (string, error) {
+	for i := 0; i < 10; i++ {
+		code, err := credentialsCode()
+		if err != nil {
+			return "", err
+		}
+
+		id, err := lookup(code)
+		if err != nil {
+			return "", err
+		}
+
+		if id == 0 {
+			return code, nil
+		}
+	}
+
+	return "", fmt.Errorf("Unable to find an unused code")
+}
+
+func randomString(alphabet string, size int) (string, error) {
+	buf := make([]byte, size)
+	for i := range buf {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+		if err != nil {
+			return "", err
+		}
+
+		buf[i] = alphabet[n.Int64()]
+	}
+
+	return string(buf), nil
+}
+
+func randomHex(size int) (string, error) {
+	buf := make([]byte, size)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCredentialsUnusedCode(t *testing.T) {
+	tests := []struct {
+		name  string
+		used  int
+		err   error
+		valid bool
+	}{
+		{"unused", 0, nil, true},
+		{"some used", 3, nil, true},
+		{"all used", 10, nil, false},
+		{"lookup failure", 0, fmt.Errorf("Database failure"), false},
+	}
+
+	for _, test := range tests {
+		calls := 0
+		code, err := credentialsUnusedCode(func(code string) (int64, error) {
+			calls++
+			if calls <= test.used {
+				return 1, nil
+			}
+
+			return 0, test.err
+		})
+
+		if test.valid && (err != nil || len(code) != 6) {
+			t.Errorf("%s: got %q, %v", test.name, code, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: got %q, expected an error", test.name, code)
+		}
+	}
+}
@@ -4,246 +4,129 @@ import (
 	"database/sql"
 	"fmt"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/mattn/go-sqlite3"
 )
 
 // Global variables
-var db *sql.DB
+var db dbBackend
+
+// dbBackend is the storage layer used by the REST handlers.
+type dbBackend interface {
+	// Schema
+	Update() error
+
+	// Sessions
+	Active() ([][]interface{}, error)
+	ActiveCount() (int, error)
+	ActiveCountForIP(ip string) (int, error)
+	ActiveCountForName(name string) (int, error)
+	ActiveCountForReservation(id int64) (int, error)
+	ActiveCountForToken(id int64) (int, error)
+	ActiveCountForUser(user string) (int, error)
+	ActiveCountForWorkshop(id int64) (int, error)
+	Expire(id int64) error
+	ExpireActive(id int64) (bool, error)
+	AddIdleTime(id int64, seconds int64) error
+	GetConsoleActivity(id int64) (string, int64, error)
+	SetConsoleActivity(id int64, date int64) error
+	GetContainer(id string, active bool) (int64, string, string, string, int64, error)
+	GetEnvironment(id int64) (string, error)
+	New(id string, proxyToken string, containerName string, containerIP string, containerUsername string, containerExpiry int64, requestDate int64, requestIP string, requestUser string, requestToken int64, requestWorkshop int64, requestReservation int64, requestTerms string, environment string) (int64, error)
+	NextExpire() (int, error)
+
+	// Proxy
+	GetProxySession(token string) (int64, string, string, error)
+	GetProxyToken(id int64) (string, error)
+
+	// File transfers
+	AddTransfer(id int64, bytes int64) error
+	GetTransfer(id int64) (int64, error)
+	ReserveTransfer(id int64, bytes int64, quota int64) (bool, error)
+
+	// Resets
+	ClaimReset(id int64, before int64) (bool, error)
+	Reset(id int64, containerIP string) error
+
+	// Snapshots
+	GetSnapshots(id int64) ([][]interface{}, error)
+	NewSnapshot(id int64, name string, size int64) error
+
+	// Feedback
+	GetFeedback(id int64) (int64, int64, string, int64, string, error)
+	RecordFeedback(id int64, feedback Feedback) error
+
+	// Statistics
+	GetStats(period string, unique bool, network *net.IPNet) (int64, error)
+
+	// Data retention
+	Anonymize(before int64, anonymizeIP func(ip string, hash string) string) (int64, error)
+	Prune(before int64) (int64, error)
+
+	// Abuse monitoring
+	GetRequester(id int64) (string, string, bool, error)
+	RecordEvent(id int64, rule string, action string, reason string) error
+
+	// Bans
+	Ban(ip string, user string, reason string) error
+	IsBanned(ip string, user string) (bool, error)
+
+	// API tokens
+	GetToken(tokenHash string) (int64, int, []string, int, error)
+	GetTokens() ([][]interface{}, error)
+	GetTokenSessions(name string) ([][]interface{}, error)
+	NewToken(name string, tokenHash string, quotaSessions int, environments []string, maxLifetime int) error
+	RevokeToken(name string) (bool, error)
+
+	// Workshops
+	EndWorkshop(id int64) error
+	GetWorkshop(code string) (int64, string, string, int, int64, int64, bool, error)
+	GetWorkshopSessions(id int64) ([][]interface{}, error)
+	NewWorkshop(code string, secretHash string, environment string, capacity int, start int64, end int64) error
+
+	// Reservations
+	DeleteReservation(code string) (bool, error)
+	GetReservation(code string) (int64, int, int64, int64, error)
+	GetReservations() ([][]interface{}, error)
+	NewReservation(code string, name string, slots int, start int64, end int64) error
+	Reserved(now int64) (int, error)
+	ReservedCapacity(start int64, end int64) (int, error)
+
+	// Console audit
+	GetConsoleInput(id string) ([][]interface{}, error)
+	RecordConsoleInput(id int64, data string) error
+
+	// Tutorials
+	GetTutorialStats() ([][]interface{}, error)
+	GetTutorialStep(id int64, tutorial string) (int, error)
+	SetTutorialStep(id int64, tutorial string, step int) error
+
+	// Logins
+	DeleteLogin(token string) error
+	GetLogin(token string) (string, error)
+	NewLogin(token string, user string, expiry int64) error
+}
 
 func dbSetup() error {
 	var err error
 
-	db, err = sql.Open("sqlite3", fmt.Sprintf("lxd-demo.sqlite3?_busy_timeout=5000&_txlock=exclusive"))
-	if err != nil {
-		return err
-	}
-
-	err = dbCreateTables()
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func dbCreateTables() error {
-	_, err := db.Exec(`
-CREATE TABLE IF NOT EXISTS sessions (
-    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
-    uuid VARCHAR(36) NOT NULL,
-    status INTEGER NOT NULL,
-    container_name VARCHAR(64) NOT NULL,
-    container_ip VARCHAR(39) NOT NULL,
-    container_username VARCHAR(10) NOT NULL,
-    container_password VARCHAR(10) NOT NULL,
-    container_expiry INT NOT NULL,
-    request_date INT NOT NULL,
-    request_ip VARCHAR(39) NOT NULL,
-    request_terms VARCHAR(64) NOT NULL
-);
-
-CREATE TABLE IF NOT EXISTS feedback (
-    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
-    session_id INTEGER NOT NULL,
-    rating INTEGER,
-    email VARCHAR(255),
-    email_use INTEGER,
-    feedback TEXT,
-    FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
-);
-`)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func dbGetStats(period string, unique bool, network *net.IPNet) (int64, error) {
-	var count int64
-
-	// Deal with unique filter
-	what := "request_ip"
-	if unique {
-		what = "distinct request_ip"
-	}
-
-	// Deal with period filter
-	where := ""
-	if period == "current" {
-		where = "WHERE status=0"
-	} else if period == "hour" {
-		creation := time.Now().Add(-time.Hour).Unix()
-		where = fmt.Sprintf("WHERE request_date > %d", creation)
-	} else if period == "day" {
-		creation := time.Now().Add(-time.Hour * 24).Unix()
-		where = fmt.Sprintf("WHERE request_date > %d", creation)
-	} else if period == "week" {
-		creation := time.Now().Add(-time.Hour * 24 * 7).Unix()
-		where = fmt.Sprintf("WHERE request_date > %d", creation)
-	} else if period == "month" {
-		creation := time.Now().Add(-time.Hour * time.Duration(24*30.5)).Unix()
-		where = fmt.Sprintf("WHERE request_date > %d", creation)
-	} else if period == "year" {
-		creation := time.Now().Add(-time.Hour * time.Duration(24*365.25)).Unix()
-		where = fmt.Sprintf("WHERE request_date > %d", creation)
-	}
-
-	if network == nil {
-		err := db.QueryRow(fmt.Sprintf("SELECT count(%s) FROM sessions %s;", what, where)).Scan(&count)
-		if err != nil {
-			return -1, err
-		}
-	} else {
-		outfmt := []interface{}{""}
-
-		q := fmt.Sprintf("SELECT %s FROM sessions %s;", what, where)
-		result, err := dbQueryScan(db, q, nil, outfmt)
-		if err != nil {
-			return -1, err
-		}
-
-		for _, ip := range result {
-			netIp := net.ParseIP(ip[0].(string))
-			if netIp == nil {
-				continue
-			}
-
-			if !network.Contains(netIp) {
-				continue
-			}
-
-			count += 1
-		}
+	dsn := config.Database
+	if dsn == "" {
+		dsn = "lxd-demo.sqlite3"
 	}
 
-	return count, nil
-}
-
-func dbActive() ([][]interface{}, error) {
-	q := fmt.Sprintf("SELECT id, container_name, container_expiry FROM sessions WHERE status=0;")
-	var containerID int
-	var containerName string
-	var containerExpiry int
-	outfmt := []interface{}{containerID, containerName, containerExpiry}
-	result, err := dbQueryScan(db, q, nil, outfmt)
-	if err != nil {
-		return nil, err
-	}
-
-	return result, nil
-}
-
-func dbGetContainer(id string, active bool) (int64, string, string, string, string, int64, error) {
-	var sessionId int64
-	var containerName string
-	var containerIP string
-	var containerUsername string
-	var containerPassword string
-	var containerExpiry int64
-	var err error
-	var rows *sql.Rows
-
-	sessionId = -1
-
-	if active {
-		rows, err = dbQuery(db, "SELECT id, container_name, container_ip, container_username, container_password, container_expiry FROM sessions WHERE status=0 AND uuid=?;", id)
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		db, err = dbPostgresOpen(dsn)
 	} else {
-		rows, err = dbQuery(db, "SELECT id, container_name, container_ip, container_username, container_password, container_expiry FROM sessions WHERE uuid=?;", id)
-	}
-	if err != nil {
-		return -1, "", "", "", "", 0, err
-	}
-
-	defer rows.Close()
-
-	for rows.Next() {
-		rows.Scan(&sessionId, &containerName, &containerIP, &containerUsername, &containerPassword, &containerExpiry)
-	}
-
-	return sessionId, containerName, containerIP, containerUsername, containerPassword, containerExpiry, nil
-}
-
-func dbGetFeedback(id int64) (int64, int64, string, int64, string, error) {
-	var feedbackId int64
-	var rating int64
-	var email string
-	var emailUse int64
-	var feedback string
-
-	feedbackId = -1
-	rating = -1
-	emailUse = -1
-	rows, err := dbQuery(db, "SELECT id, rating, email, email_use, feedback FROM feedback WHERE session_id=?;", id)
-	if err != nil {
-		return -1, -1, "", -1, "", err
-	}
-
-	defer rows.Close()
-
-	for rows.Next() {
-		rows.Scan(&feedbackId, &rating, &email, &emailUse, &feedback)
-	}
-
-	return feedbackId, rating, email, emailUse, feedback, nil
-}
-
-func dbNew(id string, containerName string, containerIP string, containerUsername string, containerPassword string, containerExpiry int64, requestDate int64, requestIP string, requestTerms string) (int64, error) {
-	res, err := db.Exec(`
-INSERT INTO sessions (
-	status,
-	uuid,
-	container_name,
-	container_ip,
-	container_username,
-	container_password,
-	container_expiry,
-	request_date,
-	request_ip,
-	request_terms) VALUES (0, ?, ?, ?, ?, ?, ?, ?, ?, ?);
-`, id, containerName, containerIP, containerUsername, containerPassword, containerExpiry, requestDate, requestIP, requestTerms)
-	if err != nil {
-		return 0, err
-	}
-
-	containerID, err := res.LastInsertId()
-	if err != nil {
-		return 0, err
+		db, err = dbSqliteOpen(dsn)
 	}
-
-	return containerID, nil
-}
-
-func dbRecordFeedback(id int64, feedback Feedback) error {
-	// Get the feedback
-	feedbackId, _, _, _, _, err := dbGetFeedback(id)
 	if err != nil {
 		return err
 	}
 
-	if feedbackId == -1 {
-		// Record new feedback
-		_, err := db.Exec(`
-INSERT INTO feedback (
-	session_id,
-	rating,
-	email,
-	email_use,
-	feedback) VALUES (?, ?, ?, ?, ?);
-`, id, feedback.Rating, feedback.Email, feedback.EmailUse, feedback.Message)
-		if err != nil {
-			return err
-		}
-
-		return nil
-	}
-
-	// Update existing feedback
-	_, err = db.Exec(`
-UPDATE feedback SET rating=?, email=?, email_use=?, feedback=? WHERE session_id=?;
-`, feedback.Rating, feedback.Email, feedback.EmailUse, feedback.Message, id)
+	err = db.Update()
 	if err != nil {
 		return err
 	}
@@ -251,45 +134,22 @@ UPDATE feedback SET rating=?, email=?, email_use=?, feedback=? WHERE session_id=
 	return nil
 }
 
-func dbExpire(id int64) error {
-	_, err := db.Exec("UPDATE sessions SET status=1 WHERE id=?;", id)
-	return err
-}
-
-func dbActiveCount() (int, error) {
-	var count int
-
-	statement := `SELECT count(*) FROM sessions WHERE status=0;`
-	err := db.QueryRow(statement).Scan(&count)
-	if err != nil {
-		return 0, err
-	}
-
-	return count, nil
-}
-
-func dbActiveCountForIP(ip string) (int, error) {
-	var count int
-
-	statement := `SELECT count(*) FROM sessions WHERE status=0 AND request_ip=?;`
-	err := db.QueryRow(statement, ip).Scan(&count)
-	if err != nil {
-		return 0, err
-	}
-
-	return count, nil
-}
+// dbRebind converts "?" placeholders into the "$N" form used by PostgreSQL.
+func dbRebind(q string) string {
+	var out strings.Builder
 
-func dbNextExpire() (int, error) {
-	var expire int
+	n := 0
+	for _, c := range q {
+		if c != '?' {
+			out.WriteRune(c)
+			continue
+		}
 
-	statement := `SELECT MIN(container_expiry) FROM sessions WHERE status=0;`
-	err := db.QueryRow(statement).Scan(&expire)
-	if err != nil {
-		return 0, err
+		n += 1
+		out.WriteString(fmt.Sprintf("$%d", n))
 	}
 
-	return expire, nil
+	return out.String()
 }
 
 func dbIsLockedError(err error) bool {
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"database/sql"
+
+	_ "github.com/lib/pq"
+)
+
+// dbPostgres stores everything in a shared PostgreSQL database, allowing
+// several front-end servers to run against the same data.
+type dbPostgres struct {
+	dbSQL
+}
+
+func dbPostgresOpen(dsn string) (*dbPostgres, error) {
+	conn, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.Ping()
+	if err != nil {
+		return nil, err
+	}
+
+	return &dbPostgres{dbSQL{conn: conn, driver: "postgres"}}, nil
+}
+
+func (d *dbPostgres) New(id string, proxyToken string, containerName string, containerIP string, containerUsername string, containerExpiry int64, requestDate int64, requestIP string, requestUser string, requestToken int64, requestWorkshop int64, requestReservation int64, requestTerms string, environment string) (int64, error) {
+	var containerID int64
+
+	// PostgreSQL doesn't support LastInsertId, get the id back from the insert
+	err := d.conn.QueryRow(d.q(`
+INSERT INTO sessions (
+	status,
+	uuid,
+	proxy_token,
+	container_name,
+	container_ip,
+	container_username,
+	container_password,
+	container_expiry,
+	request_date,
+	request_ip,
+	request_ip_hash,
+	request_user,
+	request_token,
+	request_workshop,
+	request_reservation,
+	request_terms,
+	environment) VALUES (0, ?, ?, ?, ?, ?, '', ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id;
+`), id, proxyToken, containerName, containerIP, containerUsername, containerExpiry, requestDate, requestIP, d.hashIP(requestIP), requestUser, requestToken, requestWorkshop, requestReservation, requestTerms, environment).Scan(&containerID)
+	if err != nil {
+		return 0, err
+	}
+
+	return containerID, nil
+}
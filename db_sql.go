@@ -0,0 +1,902 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// dbSQL implements the queries shared by all the database/sql backends.
+type dbSQL struct {
+	conn   *sql.DB
+	driver string
+
+	// Key used to hash client addresses, loaded from the settings table
+	ipKey []byte
+}
+
+func (d *dbSQL) q(query string) string {
+	// PostgreSQL expects "$N" rather than "?" placeholders
+	if d.driver == "postgres" {
+		return dbRebind(query)
+	}
+
+	return query
+}
+
+func (d *dbSQL) exec(query string, args ...interface{}) (sql.Result, error) {
+	return d.conn.Exec(d.q(query), args...)
+}
+
+// hashIP returns a keyed hash of the address, used for statistics so that
+// they survive the anonymization of older records.
+func (d *dbSQL) hashIP(ip string) string {
+	mac := hmac.New(sha256.New, d.ipKey)
+	io.WriteString(mac, ip)
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
+
+func (d *dbSQL) GetStats(period string, unique bool, network *net.IPNet) (int64, error) {
+	var count int64
+
+	// Deal with unique filter
+	what := "request_ip"
+	if unique {
+		what = "distinct request_ip_hash"
+	}
+
+	// Deal with period filter
+	where := ""
+	if period == "current" {
+		where = "WHERE status=0"
+	} else if period == "hour" {
+		creation := time.Now().Add(-time.Hour).Unix()
+		where = fmt.Sprintf("WHERE request_date > %d", creation)
+	} else if period == "day" {
+		creation := time.Now().Add(-time.Hour * 24).Unix()
+		where = fmt.Sprintf("WHERE request_date > %d", creation)
+	} else if period == "week" {
+		creation := time.Now().Add(-time.Hour * 24 * 7).Unix()
+		where = fmt.Sprintf("WHERE request_date > %d", creation)
+	} else if period == "month" {
+		creation := time.Now().Add(-time.Hour * time.Duration(24*30.5)).Unix()
+		where = fmt.Sprintf("WHERE request_date > %d", creation)
+	} else if period == "year" {
+		creation := time.Now().Add(-time.Hour * time.Duration(24*365.25)).Unix()
+		where = fmt.Sprintf("WHERE request_date > %d", creation)
+	}
+
+	if network == nil {
+		err := d.conn.QueryRow(fmt.Sprintf("SELECT count(%s) FROM sessions %s;", what, where)).Scan(&count)
+		if err != nil {
+			return -1, err
+		}
+	} else {
+		outfmt := []interface{}{"", ""}
+
+		// Records anonymized in hash mode no longer have an address and
+		// so can't be matched against a network.
+		q := fmt.Sprintf("SELECT request_ip, request_ip_hash FROM sessions %s;", where)
+		result, err := dbQueryScan(d.conn, q, nil, outfmt)
+		if err != nil {
+			return -1, err
+		}
+
+		seen := map[string]bool{}
+		for _, ip := range result {
+			netIp := net.ParseIP(ip[0].(string))
+			if netIp == nil {
+				continue
+			}
+
+			if !network.Contains(netIp) {
+				continue
+			}
+
+			if unique {
+				if seen[ip[1].(string)] {
+					continue
+				}
+
+				seen[ip[1].(string)] = true
+			}
+
+			count += 1
+		}
+	}
+
+	return count, nil
+}
+
+func (d *dbSQL) Active() ([][]interface{}, error) {
+	q := fmt.Sprintf("SELECT id, container_name, container_expiry FROM sessions WHERE status=0;")
+	var containerID int
+	var containerName string
+	var containerExpiry int
+	outfmt := []interface{}{containerID, containerName, containerExpiry}
+	result, err := dbQueryScan(d.conn, q, nil, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (d *dbSQL) GetContainer(id string, active bool) (int64, string, string, string, int64, error) {
+	var sessionId int64
+	var containerName string
+	var containerIP string
+	var containerUsername string
+	var containerExpiry int64
+	var err error
+	var rows *sql.Rows
+
+	sessionId = -1
+
+	if active {
+		rows, err = dbQuery(d.conn, d.q("SELECT id, container_name, container_ip, container_username, container_expiry FROM sessions WHERE status=0 AND uuid=?;"), id)
+	} else {
+		rows, err = dbQuery(d.conn, d.q("SELECT id, container_name, container_ip, container_username, container_expiry FROM sessions WHERE uuid=?;"), id)
+	}
+	if err != nil {
+		return -1, "", "", "", 0, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		rows.Scan(&sessionId, &containerName, &containerIP, &containerUsername, &containerExpiry)
+	}
+
+	return sessionId, containerName, containerIP, containerUsername, containerExpiry, nil
+}
+
+func (d *dbSQL) GetEnvironment(id int64) (string, error) {
+	var environment string
+
+	statement := `SELECT environment FROM sessions WHERE id=?;`
+	err := d.conn.QueryRow(d.q(statement), id).Scan(&environment)
+	if err != nil {
+		return "", err
+	}
+
+	return environment, nil
+}
+
+func (d *dbSQL) GetFeedback(id int64) (int64, int64, string, int64, string, error) {
+	var feedbackId int64
+	var rating int64
+	var email string
+	var emailUse int64
+	var feedback string
+
+	feedbackId = -1
+	rating = -1
+	emailUse = -1
+	rows, err := dbQuery(d.conn, d.q("SELECT id, rating, email, email_use, feedback FROM feedback WHERE session_id=?;"), id)
+	if err != nil {
+		return -1, -1, "", -1, "", err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		rows.Scan(&feedbackId, &rating, &email, &emailUse, &feedback)
+	}
+
+	return feedbackId, rating, email, emailUse, feedback, nil
+}
+
+func (d *dbSQL) RecordFeedback(id int64, feedback Feedback) error {
+	// Get the feedback
+	feedbackId, _, _, _, _, err := d.GetFeedback(id)
+	if err != nil {
+		return err
+	}
+
+	if feedbackId == -1 {
+		// Record new feedback
+		_, err := d.exec(`
+INSERT INTO feedback (
+	session_id,
+	rating,
+	email,
+	email_use,
+	feedback) VALUES (?, ?, ?, ?, ?);
+`, id, feedback.Rating, feedback.Email, feedback.EmailUse, feedback.Message)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	// Update existing feedback
+	_, err = d.exec(`
+UPDATE feedback SET rating=?, email=?, email_use=?, feedback=? WHERE session_id=?;
+`, feedback.Rating, feedback.Email, feedback.EmailUse, feedback.Message, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *dbSQL) Expire(id int64) error {
+	_, err := d.exec("UPDATE sessions SET status=1 WHERE id=?;", id)
+	return err
+}
+
+// ExpireActive expires the session unless it already ended, telling whether
+// it did.
+func (d *dbSQL) ExpireActive(id int64) (bool, error) {
+	result, err := d.exec("UPDATE sessions SET status=1 WHERE id=? AND status=0;", id)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func (d *dbSQL) AddIdleTime(id int64, seconds int64) error {
+	_, err := d.exec("UPDATE sessions SET idle_time=idle_time+? WHERE id=?;", seconds, id)
+	return err
+}
+
+// GetConsoleActivity returns the container name and last console activity
+// of an active session, the activity being -1 when the session ended.
+func (d *dbSQL) GetConsoleActivity(id int64) (string, int64, error) {
+	var containerName string
+	var activity int64
+
+	statement := `SELECT container_name, console_activity FROM sessions WHERE id=? AND status=0;`
+	err := d.conn.QueryRow(d.q(statement), id).Scan(&containerName, &activity)
+	if dbIsNoMatchError(err) {
+		return "", -1, nil
+	} else if err != nil {
+		return "", -1, err
+	}
+
+	return containerName, activity, nil
+}
+
+func (d *dbSQL) SetConsoleActivity(id int64, date int64) error {
+	_, err := d.exec("UPDATE sessions SET console_activity=? WHERE id=?;", date, id)
+	return err
+}
+
+func (d *dbSQL) ActiveCount() (int, error) {
+	var count int
+
+	statement := `SELECT count(*) FROM sessions WHERE status=0;`
+	err := d.conn.QueryRow(statement).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (d *dbSQL) ActiveCountForIP(ip string) (int, error) {
+	var count int
+
+	statement := `SELECT count(*) FROM sessions WHERE status=0 AND request_ip=?;`
+	err := d.conn.QueryRow(d.q(statement), ip).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (d *dbSQL) ActiveCountForName(name string) (int, error) {
+	var count int
+
+	statement := `SELECT count(*) FROM sessions WHERE status=0 AND container_name=?;`
+	err := d.conn.QueryRow(d.q(statement), name).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (d *dbSQL) ActiveCountForToken(id int64) (int, error) {
+	var count int
+
+	statement := `SELECT count(*) FROM sessions WHERE status=0 AND request_token=?;`
+	err := d.conn.QueryRow(d.q(statement), id).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (d *dbSQL) ActiveCountForUser(user string) (int, error) {
+	var count int
+
+	statement := `SELECT count(*) FROM sessions WHERE status=0 AND request_user=?;`
+	err := d.conn.QueryRow(d.q(statement), user).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (d *dbSQL) NextExpire() (int, error) {
+	var expire int
+
+	statement := `SELECT MIN(container_expiry) FROM sessions WHERE status=0;`
+	err := d.conn.QueryRow(statement).Scan(&expire)
+	if err != nil {
+		return 0, err
+	}
+
+	return expire, nil
+}
+
+func (d *dbSQL) Anonymize(before int64, anonymizeIP func(ip string, hash string) string) (int64, error) {
+	var count int64
+
+	q := d.q("SELECT id, request_ip, request_ip_hash FROM sessions WHERE status!=0 AND anonymized=0 AND request_date < ?;")
+	var sessionID int
+	var requestIP string
+	var requestIPHash string
+	outfmt := []interface{}{sessionID, requestIP, requestIPHash}
+	result, err := dbQueryScan(d.conn, q, []interface{}{before}, outfmt)
+	if err != nil {
+		return -1, err
+	}
+
+	for _, entry := range result {
+		_, err := d.exec("UPDATE sessions SET request_ip=?, request_user='', anonymized=1 WHERE id=?;", anonymizeIP(entry[1].(string), entry[2].(string)), entry[0].(int))
+		if err != nil {
+			return count, err
+		}
+
+		// What was typed in the console is personal data too
+		_, err = d.exec("DELETE FROM console_audit WHERE session_id=?;", entry[0].(int))
+		if err != nil {
+			return count, err
+		}
+
+		count += 1
+	}
+
+	return count, nil
+}
+
+func (d *dbSQL) Prune(before int64) (int64, error) {
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return -1, err
+	}
+
+	// Don't rely on ON DELETE CASCADE as SQLite doesn't enforce foreign keys by default
+	for _, table := range []string{"feedback", "events", "snapshots", "tutorial_progress", "console_audit"} {
+		_, err = tx.Exec(d.q(fmt.Sprintf("DELETE FROM %s WHERE session_id IN (SELECT id FROM sessions WHERE status!=0 AND request_date < ?);", table)), before)
+		if err != nil {
+			tx.Rollback()
+			return -1, err
+		}
+	}
+
+	res, err := tx.Exec(d.q("DELETE FROM sessions WHERE status!=0 AND request_date < ?;"), before)
+	if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return -1, err
+	}
+
+	return res.RowsAffected()
+}
+
+func (d *dbSQL) GetProxySession(token string) (int64, string, string, error) {
+	var sessionId int64
+	var containerName string
+	var containerIP string
+
+	statement := `SELECT id, container_name, container_ip FROM sessions WHERE status=0 AND proxy_token!='' AND proxy_token=?;`
+	err := d.conn.QueryRow(d.q(statement), token).Scan(&sessionId, &containerName, &containerIP)
+	if dbIsNoMatchError(err) {
+		return -1, "", "", nil
+	} else if err != nil {
+		return -1, "", "", err
+	}
+
+	return sessionId, containerName, containerIP, nil
+}
+
+func (d *dbSQL) GetProxyToken(id int64) (string, error) {
+	var token string
+
+	statement := `SELECT proxy_token FROM sessions WHERE id=?;`
+	err := d.conn.QueryRow(d.q(statement), id).Scan(&token)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func (d *dbSQL) AddTransfer(id int64, bytes int64) error {
+	_, err := d.exec("UPDATE sessions SET transfer_bytes=transfer_bytes+? WHERE id=?;", bytes, id)
+	return err
+}
+
+// ReserveTransfer accounts for a transfer of "bytes", unless that'd take the
+// session over "quota".
+func (d *dbSQL) ReserveTransfer(id int64, bytes int64, quota int64) (bool, error) {
+	result, err := d.exec("UPDATE sessions SET transfer_bytes=transfer_bytes+? WHERE id=? AND transfer_bytes+? <= ?;", bytes, id, bytes, quota)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return count == 1, nil
+}
+
+func (d *dbSQL) GetTransfer(id int64) (int64, error) {
+	var transferred int64
+
+	statement := `SELECT transfer_bytes FROM sessions WHERE id=?;`
+	err := d.conn.QueryRow(d.q(statement), id).Scan(&transferred)
+	if err != nil {
+		return -1, err
+	}
+
+	return transferred, nil
+}
+
+// ClaimReset records a reset of the session, unless it was last reset after "before".
+func (d *dbSQL) ClaimReset(id int64, before int64) (bool, error) {
+	res, err := d.exec("UPDATE sessions SET last_reset=? WHERE id=? AND last_reset <= ?;", time.Now().Unix(), id, before)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func (d *dbSQL) Reset(id int64, containerIP string) error {
+	_, err := d.exec("UPDATE sessions SET container_ip=? WHERE id=?;", containerIP, id)
+	if err != nil {
+		return err
+	}
+
+	// The snapshots went away with the old container
+	_, err = d.exec("DELETE FROM snapshots WHERE session_id=?;", id)
+	return err
+}
+
+func (d *dbSQL) GetSnapshots(id int64) ([][]interface{}, error) {
+	q := d.q("SELECT name, date, size FROM snapshots WHERE session_id=? ORDER BY id;")
+	var name string
+	var date int
+	var size int
+	outfmt := []interface{}{name, date, size}
+	result, err := dbQueryScan(d.conn, q, []interface{}{id}, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (d *dbSQL) NewSnapshot(id int64, name string, size int64) error {
+	_, err := d.exec("INSERT INTO snapshots (session_id, name, date, size) VALUES (?, ?, ?, ?);", id, name, time.Now().Unix(), size)
+	return err
+}
+
+// GetRequester returns the address and user who requested the session, and
+// whether it was requested with an API token, workshop or reservation code.
+func (d *dbSQL) GetRequester(id int64) (string, string, bool, error) {
+	var requestIP string
+	var requestUser string
+	var requestToken int64
+	var requestWorkshop int64
+	var requestReservation int64
+
+	statement := `SELECT request_ip, request_user, request_token, request_workshop, request_reservation FROM sessions WHERE id=?;`
+	err := d.conn.QueryRow(d.q(statement), id).Scan(&requestIP, &requestUser, &requestToken, &requestWorkshop, &requestReservation)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	return requestIP, requestUser, requestToken != 0 || requestWorkshop != 0 || requestReservation != 0, nil
+}
+
+func (d *dbSQL) RecordEvent(id int64, rule string, action string, reason string) error {
+	_, err := d.exec("INSERT INTO events (session_id, date, rule, action, reason) VALUES (?, ?, ?, ?, ?);", id, time.Now().Unix(), rule, action, reason)
+	return err
+}
+
+func (d *dbSQL) Ban(ip string, user string, reason string) error {
+	_, err := d.exec("INSERT INTO bans (ip, user_id, reason, date) VALUES (?, ?, ?, ?);", ip, user, reason, time.Now().Unix())
+	return err
+}
+
+func (d *dbSQL) IsBanned(ip string, user string) (bool, error) {
+	var count int
+
+	statement := `SELECT count(*) FROM bans WHERE (ip!='' AND ip=?) OR (user_id!='' AND user_id=?);`
+	err := d.conn.QueryRow(d.q(statement), ip, user).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// GetToken returns the id, session quota, allowed environments and maximum
+// session lifetime of a valid API token, the id being 0 if there's none.
+func (d *dbSQL) GetToken(tokenHash string) (int64, int, []string, int, error) {
+	var id int64
+	var quotaSessions int
+	var environments string
+	var maxLifetime int
+
+	statement := `SELECT id, quota_sessions, environments, max_lifetime FROM api_tokens WHERE token=? AND revoked=0;`
+	err := d.conn.QueryRow(d.q(statement), tokenHash).Scan(&id, &quotaSessions, &environments, &maxLifetime)
+	if dbIsNoMatchError(err) {
+		return 0, 0, nil, 0, nil
+	} else if err != nil {
+		return 0, 0, nil, 0, err
+	}
+
+	allowed := []string{}
+	if environments != "" {
+		allowed = strings.Split(environments, ",")
+	}
+
+	return id, quotaSessions, allowed, maxLifetime, nil
+}
+
+func (d *dbSQL) GetTokens() ([][]interface{}, error) {
+	q := "SELECT name, quota_sessions, environments, max_lifetime, created, revoked FROM api_tokens ORDER BY id;"
+	var name string
+	var quotaSessions int
+	var environments string
+	var maxLifetime int
+	var created int
+	var revoked int
+	outfmt := []interface{}{name, quotaSessions, environments, maxLifetime, created, revoked}
+	result, err := dbQueryScan(d.conn, q, nil, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (d *dbSQL) GetTokenSessions(name string) ([][]interface{}, error) {
+	q := d.q("SELECT sessions.uuid, sessions.status, sessions.environment, sessions.request_date, sessions.request_ip FROM sessions JOIN api_tokens ON api_tokens.id=sessions.request_token WHERE api_tokens.name=? ORDER BY sessions.id;")
+	var uuid string
+	var status int
+	var environment string
+	var requestDate int
+	var requestIP string
+	outfmt := []interface{}{uuid, status, environment, requestDate, requestIP}
+	result, err := dbQueryScan(d.conn, q, []interface{}{name}, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (d *dbSQL) NewToken(name string, tokenHash string, quotaSessions int, environments []string, maxLifetime int) error {
+	_, err := d.exec("INSERT INTO api_tokens (name, token, quota_sessions, environments, max_lifetime, created, revoked) VALUES (?, ?, ?, ?, ?, ?, 0);", name, tokenHash, quotaSessions, strings.Join(environments, ","), maxLifetime, time.Now().Unix())
+	return err
+}
+
+func (d *dbSQL) RevokeToken(name string) (bool, error) {
+	res, err := d.exec("UPDATE api_tokens SET revoked=? WHERE name=? AND revoked=0;", time.Now().Unix(), name)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func (d *dbSQL) ActiveCountForWorkshop(id int64) (int, error) {
+	var count int
+
+	statement := `SELECT count(*) FROM sessions WHERE status=0 AND request_workshop=?;`
+	err := d.conn.QueryRow(d.q(statement), id).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (d *dbSQL) EndWorkshop(id int64) error {
+	_, err := d.exec("UPDATE workshops SET ended=? WHERE id=?;", time.Now().Unix(), id)
+	return err
+}
+
+// GetWorkshop returns the id, instructor secret hash, environment,
+// capacity, time window and whether it was ended early of a workshop, the
+// id being 0 if there's none.
+func (d *dbSQL) GetWorkshop(code string) (int64, string, string, int, int64, int64, bool, error) {
+	var id int64
+	var secretHash string
+	var environment string
+	var capacity int
+	var start int64
+	var end int64
+	var ended int64
+
+	statement := `SELECT id, secret, environment, capacity, start_date, end_date, ended FROM workshops WHERE code=?;`
+	err := d.conn.QueryRow(d.q(statement), code).Scan(&id, &secretHash, &environment, &capacity, &start, &end, &ended)
+	if dbIsNoMatchError(err) {
+		return 0, "", "", 0, 0, 0, false, nil
+	} else if err != nil {
+		return 0, "", "", 0, 0, 0, false, err
+	}
+
+	return id, secretHash, environment, capacity, start, end, ended != 0, nil
+}
+
+func (d *dbSQL) GetWorkshopSessions(id int64) ([][]interface{}, error) {
+	q := d.q("SELECT id, uuid, container_name, status, request_date, container_expiry FROM sessions WHERE request_workshop=? ORDER BY id;")
+	var sessionId int
+	var uuid string
+	var containerName string
+	var status int
+	var requestDate int
+	var containerExpiry int
+	outfmt := []interface{}{sessionId, uuid, containerName, status, requestDate, containerExpiry}
+	result, err := dbQueryScan(d.conn, q, []interface{}{id}, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (d *dbSQL) NewWorkshop(code string, secretHash string, environment string, capacity int, start int64, end int64) error {
+	_, err := d.exec("INSERT INTO workshops (code, secret, environment, capacity, start_date, end_date, ended) VALUES (?, ?, ?, ?, ?, ?, 0);", code, secretHash, environment, capacity, start, end)
+	return err
+}
+
+func (d *dbSQL) ActiveCountForReservation(id int64) (int, error) {
+	var count int
+
+	statement := `SELECT count(*) FROM sessions WHERE status=0 AND request_reservation=?;`
+	err := d.conn.QueryRow(d.q(statement), id).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (d *dbSQL) DeleteReservation(code string) (bool, error) {
+	res, err := d.exec("DELETE FROM reservations WHERE code=?;", code)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// GetReservation returns the id, number of slots and time window of a
+// reservation, the id being 0 if there's none.
+func (d *dbSQL) GetReservation(code string) (int64, int, int64, int64, error) {
+	var id int64
+	var slots int
+	var start int64
+	var end int64
+
+	statement := `SELECT id, slots, start_date, end_date FROM reservations WHERE code=?;`
+	err := d.conn.QueryRow(d.q(statement), code).Scan(&id, &slots, &start, &end)
+	if dbIsNoMatchError(err) {
+		return 0, 0, 0, 0, nil
+	} else if err != nil {
+		return 0, 0, 0, 0, err
+	}
+
+	return id, slots, start, end, nil
+}
+
+func (d *dbSQL) GetReservations() ([][]interface{}, error) {
+	q := "SELECT code, name, slots, start_date, end_date, (SELECT count(*) FROM sessions WHERE status=0 AND request_reservation=reservations.id) FROM reservations ORDER BY start_date;"
+	var code string
+	var name string
+	var slots int
+	var start int
+	var end int
+	var active int
+	outfmt := []interface{}{code, name, slots, start, end, active}
+	result, err := dbQueryScan(d.conn, q, nil, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (d *dbSQL) NewReservation(code string, name string, slots int, start int64, end int64) error {
+	_, err := d.exec("INSERT INTO reservations (code, name, slots, start_date, end_date) VALUES (?, ?, ?, ?, ?);", code, name, slots, start, end)
+	return err
+}
+
+// Reserved returns the number of slots currently held back for workshop
+// attendees and reservation code holders who haven't started a session yet.
+func (d *dbSQL) Reserved(now int64) (int, error) {
+	var workshops int
+	var reservations int
+
+	statement := `SELECT COALESCE(SUM(capacity - (SELECT count(*) FROM sessions WHERE status=0 AND request_workshop=workshops.id)), 0) FROM workshops WHERE ended=0 AND start_date<=? AND end_date>?;`
+	err := d.conn.QueryRow(d.q(statement), now, now).Scan(&workshops)
+	if err != nil {
+		return 0, err
+	}
+
+	statement = `SELECT COALESCE(SUM(slots - (SELECT count(*) FROM sessions WHERE status=0 AND request_reservation=reservations.id)), 0) FROM reservations WHERE start_date<=? AND end_date>?;`
+	err = d.conn.QueryRow(d.q(statement), now, now).Scan(&reservations)
+	if err != nil {
+		return 0, err
+	}
+
+	return workshops + reservations, nil
+}
+
+// ReservedCapacity returns the total capacity of the workshops and
+// reservations overlapping the given time window.
+func (d *dbSQL) ReservedCapacity(start int64, end int64) (int, error) {
+	var workshops int
+	var reservations int
+
+	statement := `SELECT COALESCE(SUM(capacity), 0) FROM workshops WHERE ended=0 AND start_date<? AND end_date>?;`
+	err := d.conn.QueryRow(d.q(statement), end, start).Scan(&workshops)
+	if err != nil {
+		return 0, err
+	}
+
+	statement = `SELECT COALESCE(SUM(slots), 0) FROM reservations WHERE start_date<? AND end_date>?;`
+	err = d.conn.QueryRow(d.q(statement), end, start).Scan(&reservations)
+	if err != nil {
+		return 0, err
+	}
+
+	return workshops + reservations, nil
+}
+
+// GetConsoleInput returns the audited console input of the session with the
+// given uuid.
+func (d *dbSQL) GetConsoleInput(id string) ([][]interface{}, error) {
+	q := d.q("SELECT console_audit.date, console_audit.data FROM console_audit JOIN sessions ON sessions.id=console_audit.session_id WHERE sessions.uuid=? ORDER BY console_audit.id;")
+	var date int
+	var data string
+	outfmt := []interface{}{date, data}
+	result, err := dbQueryScan(d.conn, q, []interface{}{id}, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (d *dbSQL) RecordConsoleInput(id int64, data string) error {
+	_, err := d.exec("INSERT INTO console_audit (session_id, date, data) VALUES (?, ?, ?);", id, time.Now().Unix(), data)
+	return err
+}
+
+// GetTutorialStats returns the number of sessions having completed each
+// step of the tutorials.
+func (d *dbSQL) GetTutorialStats() ([][]interface{}, error) {
+	q := "SELECT tutorial, step, count(*) FROM tutorial_progress GROUP BY tutorial, step ORDER BY tutorial, step;"
+	var tutorial string
+	var step int
+	var count int
+	outfmt := []interface{}{tutorial, step, count}
+	result, err := dbQueryScan(d.conn, q, nil, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// GetTutorialStep returns the number of steps of the tutorial completed
+// in the session, -1 if it wasn't started.
+func (d *dbSQL) GetTutorialStep(id int64, tutorial string) (int, error) {
+	var step int
+
+	statement := `SELECT step FROM tutorial_progress WHERE session_id=? AND tutorial=?;`
+	err := d.conn.QueryRow(d.q(statement), id, tutorial).Scan(&step)
+	if dbIsNoMatchError(err) {
+		return -1, nil
+	} else if err != nil {
+		return -1, err
+	}
+
+	return step, nil
+}
+
+func (d *dbSQL) SetTutorialStep(id int64, tutorial string, step int) error {
+	res, err := d.exec("UPDATE tutorial_progress SET step=?, updated=? WHERE session_id=? AND tutorial=?;", step, time.Now().Unix(), id, tutorial)
+	if err != nil {
+		return err
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return nil
+	}
+
+	_, err = d.exec("INSERT INTO tutorial_progress (session_id, tutorial, step, updated) VALUES (?, ?, ?, ?);", id, tutorial, step, time.Now().Unix())
+	return err
+}
+
+func (d *dbSQL) DeleteLogin(token string) error {
+	_, err := d.exec("DELETE FROM logins WHERE token=?;", token)
+	return err
+}
+
+func (d *dbSQL) GetLogin(token string) (string, error) {
+	var user string
+
+	statement := `SELECT user_id FROM logins WHERE token=? AND expiry > ?;`
+	err := d.conn.QueryRow(d.q(statement), token, time.Now().Unix()).Scan(&user)
+	if dbIsNoMatchError(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return user, nil
+}
+
+func (d *dbSQL) NewLogin(token string, user string, expiry int64) error {
+	// Drop expired logins
+	_, err := d.exec("DELETE FROM logins WHERE expiry <= ?;", time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	_, err = d.exec("INSERT INTO logins (token, user_id, expiry) VALUES (?, ?, ?);", token, user, expiry)
+	return err
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// dbSqlite stores everything in a local SQLite database file.
+type dbSqlite struct {
+	dbSQL
+}
+
+func dbSqliteOpen(path string) (*dbSqlite, error) {
+	conn, err := sql.Open("sqlite3", fmt.Sprintf("%s?_busy_timeout=5000&_txlock=exclusive", path))
+	if err != nil {
+		return nil, err
+	}
+
+	return &dbSqlite{dbSQL{conn: conn, driver: "sqlite3"}}, nil
+}
+
+func (d *dbSqlite) New(id string, proxyToken string, containerName string, containerIP string, containerUsername string, containerExpiry int64, requestDate int64, requestIP string, requestUser string, requestToken int64, requestWorkshop int64, requestReservation int64, requestTerms string, environment string) (int64, error) {
+	res, err := d.conn.Exec(`
+INSERT INTO sessions (
+	status,
+	uuid,
+	proxy_token,
+	container_name,
+	container_ip,
+	container_username,
+	container_password,
+	container_expiry,
+	request_date,
+	request_ip,
+	request_ip_hash,
+	request_user,
+	request_token,
+	request_workshop,
+	request_reservation,
+	request_terms,
+	environment) VALUES (0, ?, ?, ?, ?, ?, '', ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+`, id, proxyToken, containerName, containerIP, containerUsername, containerExpiry, requestDate, requestIP, d.hashIP(requestIP), requestUser, requestToken, requestWorkshop, requestReservation, requestTerms, environment)
+	if err != nil {
+		return 0, err
+	}
+
+	containerID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return containerID, nil
+}
@@ -0,0 +1,723 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// dbTestPostgresEnv names the environment variable holding the DSN of a
+// throwaway PostgreSQL database. Its public schema is wiped by the tests.
+const dbTestPostgresEnv = "LXD_DEMO_TEST_POSTGRES"
+
+// dbTestOpen calls fn with an empty, unmigrated, instance of every backend
+// available in this environment.
+func dbTestOpen(t *testing.T, fn func(t *testing.T, d dbBackend, conn *sql.DB)) {
+	t.Run("sqlite", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "lxd-demo-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		d, err := dbSqliteOpen(filepath.Join(dir, "lxd-demo.sqlite3"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.conn.Close()
+
+		fn(t, d, d.conn)
+	})
+
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv(dbTestPostgresEnv)
+		if dsn == "" {
+			t.Skipf("%s isn't set", dbTestPostgresEnv)
+		}
+
+		d, err := dbPostgresOpen(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.conn.Close()
+
+		_, err = d.conn.Exec("DROP SCHEMA public CASCADE; CREATE SCHEMA public;")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fn(t, d, d.conn)
+	})
+}
+
+// dbTestBackends calls fn with a freshly migrated instance of every backend
+// available in this environment.
+func dbTestBackends(t *testing.T, fn func(t *testing.T, d dbBackend)) {
+	dbTestOpen(t, func(t *testing.T, d dbBackend, conn *sql.DB) {
+		err := d.Update()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fn(t, d)
+	})
+}
+
+// dbTestGlobal points the global database at a freshly migrated SQLite
+// database, returning a function undoing it.
+func dbTestGlobal(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "lxd-demo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := dbSqliteOpen(filepath.Join(dir, "lxd-demo.sqlite3"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	err = d.Update()
+	if err != nil {
+		d.conn.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	previous := db
+	db = d
+
+	return func() {
+		db = previous
+		d.conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// dbTestSession creates an active session, returning its database id.
+func dbTestSession(t *testing.T, d dbBackend, uuid string, ip string, date int64) int64 {
+	id, err := d.New(uuid, "proxy-"+uuid, "tryit-"+uuid, "10.0.0.1", "user", date+3600, date, ip, "", 0, 0, 0, "terms", "")
+	if err != nil {
+		t.Fatalf("New(%s): %s", uuid, err)
+	}
+
+	return id
+}
+
+func TestDbRebind(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT 1;", "SELECT 1;"},
+		{"SELECT * FROM sessions WHERE id=?;", "SELECT * FROM sessions WHERE id=$1;"},
+		{"UPDATE sessions SET a=?, b=? WHERE id=?;", "UPDATE sessions SET a=$1, b=$2 WHERE id=$3;"},
+	}
+
+	for _, test := range tests {
+		got := dbRebind(test.query)
+		if got != test.want {
+			t.Errorf("dbRebind(%q) = %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestDbSessions(t *testing.T) {
+	dbTestBackends(t, func(t *testing.T, d dbBackend) {
+		now := time.Now().Unix()
+		id := dbTestSession(t, d, "session-1", "10.1.1.1", now)
+
+		sessionId, containerName, containerIP, containerUsername, containerExpiry, err := d.GetContainer("session-1", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if sessionId != id || containerName != "tryit-session-1" || containerIP != "10.0.0.1" || containerUsername != "user" || containerExpiry != now+3600 {
+			t.Fatalf("GetContainer returned %d, %s, %s, %s, %d", sessionId, containerName, containerIP, containerUsername, containerExpiry)
+		}
+
+		sessionId, _, _, _, _, err = d.GetContainer("missing", false)
+		if err != nil || sessionId != -1 {
+			t.Fatalf("GetContainer of a missing session returned %d, %v", sessionId, err)
+		}
+
+		counts := []struct {
+			name  string
+			count func() (int, error)
+			want  int
+		}{
+			{"ActiveCount", d.ActiveCount, 1},
+			{"ActiveCountForIP", func() (int, error) { return d.ActiveCountForIP("10.1.1.1") }, 1},
+			{"ActiveCountForName", func() (int, error) { return d.ActiveCountForName("tryit-session-1") }, 1},
+			{"ActiveCountForUser", func() (int, error) { return d.ActiveCountForUser("someone") }, 0},
+			{"ActiveCountForToken", func() (int, error) { return d.ActiveCountForToken(1) }, 0},
+			{"ActiveCountForWorkshop", func() (int, error) { return d.ActiveCountForWorkshop(1) }, 0},
+			{"ActiveCountForReservation", func() (int, error) { return d.ActiveCountForReservation(1) }, 0},
+		}
+
+		for _, test := range counts {
+			got, err := test.count()
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+
+			if got != test.want {
+				t.Errorf("%s = %d, want %d", test.name, got, test.want)
+			}
+		}
+
+		next, err := d.NextExpire()
+		if err != nil || int64(next) != now+3600 {
+			t.Errorf("NextExpire = %d, %v", next, err)
+		}
+
+		active, err := d.Active()
+		if err != nil || len(active) != 1 {
+			t.Fatalf("Active = %v, %v", active, err)
+		}
+
+		environment, err := d.GetEnvironment(id)
+		if err != nil || environment != "" {
+			t.Errorf("GetEnvironment = %q, %v", environment, err)
+		}
+
+		proxyToken, err := d.GetProxyToken(id)
+		if err != nil || proxyToken != "proxy-session-1" {
+			t.Errorf("GetProxyToken = %q, %v", proxyToken, err)
+		}
+
+		proxies := []struct {
+			token string
+			want  int64
+		}{
+			{"proxy-session-1", id},
+			{"session-1", -1},
+			{"", -1},
+		}
+
+		for _, test := range proxies {
+			sessionId, containerName, containerIP, err := d.GetProxySession(test.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if sessionId != test.want || (sessionId != -1 && (containerName != "tryit-session-1" || containerIP != "10.0.0.1")) {
+				t.Errorf("GetProxySession(%q) = %d, %s, %s, want %d", test.token, sessionId, containerName, containerIP, test.want)
+			}
+		}
+
+		err = d.Expire(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sessionId, _, _, _, _, err = d.GetContainer("session-1", true)
+		if err != nil || sessionId != -1 {
+			t.Errorf("GetContainer found an expired session as active: %d, %v", sessionId, err)
+		}
+
+		sessionId, _, _, _, _, err = d.GetContainer("session-1", false)
+		if err != nil || sessionId != id {
+			t.Errorf("GetContainer didn't find the expired session: %d, %v", sessionId, err)
+		}
+
+		sessionId, _, _, err = d.GetProxySession("proxy-session-1")
+		if err != nil || sessionId != -1 {
+			t.Errorf("GetProxySession found an expired session: %d, %v", sessionId, err)
+		}
+
+		count, err := d.ActiveCount()
+		if err != nil || count != 0 {
+			t.Errorf("ActiveCount after Expire = %d, %v", count, err)
+		}
+
+		// Only active sessions get expired again
+		expired, err := d.ExpireActive(id)
+		if err != nil || expired {
+			t.Errorf("ExpireActive of an expired session = %v, %v", expired, err)
+		}
+
+		other := dbTestSession(t, d, "session-2", "10.1.1.1", now)
+		expired, err = d.ExpireActive(other)
+		if err != nil || !expired {
+			t.Errorf("ExpireActive = %v, %v", expired, err)
+		}
+
+		_, activity, err := d.GetConsoleActivity(other)
+		if err != nil || activity != -1 {
+			t.Errorf("GetConsoleActivity of an expired session = %d, %v", activity, err)
+		}
+	})
+}
+
+func TestDbStats(t *testing.T) {
+	dbTestBackends(t, func(t *testing.T, d dbBackend) {
+		now := time.Now().Unix()
+		dbTestSession(t, d, "session-1", "10.1.1.1", now)
+		dbTestSession(t, d, "session-2", "10.1.1.1", now)
+		dbTestSession(t, d, "session-3", "10.2.2.2", now)
+		old := dbTestSession(t, d, "session-4", "2001:db8::1", now-2*24*3600)
+
+		err := d.Expire(old)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, network, _ := net.ParseCIDR("10.1.0.0/16")
+		_, network6, _ := net.ParseCIDR("2001:db8::/32")
+
+		tests := []struct {
+			period  string
+			unique  bool
+			network *net.IPNet
+			want    int64
+		}{
+			{"total", false, nil, 4},
+			{"total", true, nil, 3},
+			{"current", false, nil, 3},
+			{"day", false, nil, 3},
+			{"week", true, nil, 3},
+			{"total", false, network, 2},
+			{"total", true, network, 1},
+			{"total", false, network6, 1},
+			{"current", false, network6, 0},
+		}
+
+		for _, test := range tests {
+			got, err := d.GetStats(test.period, test.unique, test.network)
+			if err != nil {
+				t.Fatalf("GetStats(%s, %v, %v): %s", test.period, test.unique, test.network, err)
+			}
+
+			if got != test.want {
+				t.Errorf("GetStats(%s, %v, %v) = %d, want %d", test.period, test.unique, test.network, got, test.want)
+			}
+		}
+
+		// Statistics survive anonymization
+		count, err := d.Anonymize(now, func(ip string, hash string) string { return hash })
+		if err != nil || count != 1 {
+			t.Fatalf("Anonymize = %d, %v", count, err)
+		}
+
+		got, err := d.GetStats("total", true, nil)
+		if err != nil || got != 3 {
+			t.Errorf("GetStats after Anonymize = %d, %v", got, err)
+		}
+
+		count, err = d.Prune(now)
+		if err != nil || count != 1 {
+			t.Fatalf("Prune = %d, %v", count, err)
+		}
+
+		got, err = d.GetStats("total", false, nil)
+		if err != nil || got != 3 {
+			t.Errorf("GetStats after Prune = %d, %v", got, err)
+		}
+	})
+}
+
+func TestDbBans(t *testing.T) {
+	dbTestBackends(t, func(t *testing.T, d dbBackend) {
+		err := d.Ban("10.1.1.1", "", "abuse")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = d.Ban("", "some-subject", "abuse")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			ip   string
+			user string
+			want bool
+		}{
+			{"10.1.1.1", "", true},
+			{"10.2.2.2", "", false},
+			{"10.2.2.2", "some-subject", true},
+			{"10.2.2.2", "someone-else", false},
+			{"", "", false},
+		}
+
+		for _, test := range tests {
+			got, err := d.IsBanned(test.ip, test.user)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != test.want {
+				t.Errorf("IsBanned(%q, %q) = %v, want %v", test.ip, test.user, got, test.want)
+			}
+		}
+	})
+}
+
+func TestDbSessionData(t *testing.T) {
+	dbTestBackends(t, func(t *testing.T, d dbBackend) {
+		now := time.Now().Unix()
+		id := dbTestSession(t, d, "session-1", "10.1.1.1", now)
+
+		// Feedback
+		err := d.RecordFeedback(id, Feedback{Rating: 4, Message: "nice"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = d.RecordFeedback(id, Feedback{Rating: 5, Message: "great"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		feedbackId, rating, _, _, message, err := d.GetFeedback(id)
+		if err != nil || feedbackId == -1 || rating != 5 || message != "great" {
+			t.Errorf("GetFeedback = %d, %d, %q, %v", feedbackId, rating, message, err)
+		}
+
+		// File transfers
+		err = d.AddTransfer(id, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		transferred, err := d.GetTransfer(id)
+		if err != nil || transferred != 100 {
+			t.Errorf("GetTransfer = %d, %v", transferred, err)
+		}
+
+		reservations := []struct {
+			bytes int64
+			want  bool
+		}{
+			{800, true},
+			{101, false},
+			{100, true},
+			{1, false},
+		}
+
+		for _, test := range reservations {
+			reserved, err := d.ReserveTransfer(id, test.bytes, 1000)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if reserved != test.want {
+				t.Errorf("ReserveTransfer(%d) = %v, want %v", test.bytes, reserved, test.want)
+			}
+		}
+
+		// Give back part of a reservation
+		err = d.AddTransfer(id, -500)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		transferred, err = d.GetTransfer(id)
+		if err != nil || transferred != 500 {
+			t.Errorf("GetTransfer after reservations = %d, %v", transferred, err)
+		}
+
+		// Resets
+		claimed, err := d.ClaimReset(id, time.Now().Unix()-300)
+		if err != nil || !claimed {
+			t.Fatalf("first ClaimReset = %v, %v", claimed, err)
+		}
+
+		claimed, err = d.ClaimReset(id, time.Now().Unix()-300)
+		if err != nil || claimed {
+			t.Errorf("second ClaimReset = %v, %v", claimed, err)
+		}
+
+		// Snapshots
+		err = d.NewSnapshot(id, "snap0", 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		snapshots, err := d.GetSnapshots(id)
+		if err != nil || len(snapshots) != 1 {
+			t.Fatalf("GetSnapshots = %v, %v", snapshots, err)
+		}
+
+		err = d.Reset(id, "10.0.0.2")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, containerIP, _, _, err := d.GetContainer("session-1", true)
+		if err != nil || containerIP != "10.0.0.2" {
+			t.Errorf("GetContainer after Reset = %s, %v", containerIP, err)
+		}
+
+		snapshots, err = d.GetSnapshots(id)
+		if err != nil || len(snapshots) != 0 {
+			t.Errorf("GetSnapshots after Reset = %v, %v", snapshots, err)
+		}
+
+		// Abuse monitoring
+		ip, user, shared, err := d.GetRequester(id)
+		if err != nil || ip != "10.1.1.1" || user != "" || shared {
+			t.Errorf("GetRequester = %s, %s, %v, %v", ip, user, shared, err)
+		}
+
+		err = d.RecordEvent(id, "cpu-miner", "throttle", "cpu at 100%")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Idle time
+		err = d.AddIdleTime(id, 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		containerName, activity, err := d.GetConsoleActivity(id)
+		if err != nil || containerName != "tryit-session-1" || activity != 0 {
+			t.Errorf("GetConsoleActivity = %s, %d, %v", containerName, activity, err)
+		}
+
+		err = d.SetConsoleActivity(id, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, activity, err = d.GetConsoleActivity(id)
+		if err != nil || activity != now {
+			t.Errorf("GetConsoleActivity after SetConsoleActivity = %d, %v", activity, err)
+		}
+
+		// Console audit
+		err = d.RecordConsoleInput(id, "ls -l")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		input, err := d.GetConsoleInput("session-1")
+		if err != nil || len(input) != 1 || input[0][1].(string) != "ls -l" {
+			t.Errorf("GetConsoleInput = %v, %v", input, err)
+		}
+
+		// Tutorials
+		step, err := d.GetTutorialStep(id, "first-steps")
+		if err != nil || step != -1 {
+			t.Errorf("GetTutorialStep before starting = %d, %v", step, err)
+		}
+
+		for _, step := range []int{0, 1} {
+			err = d.SetTutorialStep(id, "first-steps", step)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		step, err = d.GetTutorialStep(id, "first-steps")
+		if err != nil || step != 1 {
+			t.Errorf("GetTutorialStep = %d, %v", step, err)
+		}
+
+		stats, err := d.GetTutorialStats()
+		if err != nil || len(stats) != 1 || stats[0][1].(int) != 1 || stats[0][2].(int) != 1 {
+			t.Errorf("GetTutorialStats = %v, %v", stats, err)
+		}
+
+		// Everything goes away with the session
+		err = d.Expire(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		count, err := d.Anonymize(time.Now().Unix()+1, func(ip string, hash string) string { return hash })
+		if err != nil || count != 1 {
+			t.Fatalf("Anonymize = %d, %v", count, err)
+		}
+
+		input, err = d.GetConsoleInput("session-1")
+		if err != nil || len(input) != 0 {
+			t.Errorf("GetConsoleInput after Anonymize = %v, %v", input, err)
+		}
+
+		count, err = d.Prune(time.Now().Unix() + 1)
+		if err != nil || count != 1 {
+			t.Errorf("Prune = %d, %v", count, err)
+		}
+	})
+}
+
+func TestDbTokens(t *testing.T) {
+	dbTestBackends(t, func(t *testing.T, d dbBackend) {
+		err := d.NewToken("ci", "hash", 5, []string{"default", "builder"}, 600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = d.NewToken("ci", "other-hash", 5, nil, 0)
+		if err == nil {
+			t.Errorf("NewToken accepted a duplicate name")
+		}
+
+		id, quota, environments, maxLifetime, err := d.GetToken("hash")
+		if err != nil || id == 0 || quota != 5 || len(environments) != 2 || maxLifetime != 600 {
+			t.Fatalf("GetToken = %d, %d, %v, %d, %v", id, quota, environments, maxLifetime, err)
+		}
+
+		_, err = d.New("session-1", "", "tryit-1", "10.0.0.1", "user", 0, time.Now().Unix(), "10.1.1.1", "", id, 0, 0, "", "builder")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		count, err := d.ActiveCountForToken(id)
+		if err != nil || count != 1 {
+			t.Errorf("ActiveCountForToken = %d, %v", count, err)
+		}
+
+		sessions, err := d.GetTokenSessions("ci")
+		if err != nil || len(sessions) != 1 || sessions[0][2].(string) != "builder" {
+			t.Errorf("GetTokenSessions = %v, %v", sessions, err)
+		}
+
+		tokens, err := d.GetTokens()
+		if err != nil || len(tokens) != 1 {
+			t.Errorf("GetTokens = %v, %v", tokens, err)
+		}
+
+		revoked, err := d.RevokeToken("ci")
+		if err != nil || !revoked {
+			t.Fatalf("RevokeToken = %v, %v", revoked, err)
+		}
+
+		revoked, err = d.RevokeToken("ci")
+		if err != nil || revoked {
+			t.Errorf("second RevokeToken = %v, %v", revoked, err)
+		}
+
+		id, _, _, _, err = d.GetToken("hash")
+		if err != nil || id != 0 {
+			t.Errorf("GetToken of a revoked token = %d, %v", id, err)
+		}
+	})
+}
+
+func TestDbReservations(t *testing.T) {
+	dbTestBackends(t, func(t *testing.T, d dbBackend) {
+		now := time.Now().Unix()
+
+		err := d.NewWorkshop("WORK01", "hash", "", 10, now-60, now+3600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = d.NewReservation("RESV01", "webinar", 5, now-60, now+3600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = d.NewReservation("RESV02", "later", 20, now+7200, now+10800)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		workshop, _, _, capacity, _, _, ended, err := d.GetWorkshop("WORK01")
+		if err != nil || workshop == 0 || capacity != 10 || ended {
+			t.Fatalf("GetWorkshop = %d, %d, %v, %v", workshop, capacity, ended, err)
+		}
+
+		reservation, slots, _, _, err := d.GetReservation("RESV01")
+		if err != nil || reservation == 0 || slots != 5 {
+			t.Fatalf("GetReservation = %d, %d, %v", reservation, slots, err)
+		}
+
+		_, err = d.New("session-1", "", "tryit-1", "10.0.0.1", "user", now+3600, now, "10.1.1.1", "", 0, workshop, 0, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = d.New("session-2", "", "tryit-2", "10.0.0.2", "user", now+3600, now, "10.1.1.1", "", 0, 0, reservation, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reserved, err := d.Reserved(now)
+		if err != nil || reserved != 9+4 {
+			t.Errorf("Reserved = %d, %v", reserved, err)
+		}
+
+		capacity, err = d.ReservedCapacity(now, now+10800)
+		if err != nil || capacity != 10+5+20 {
+			t.Errorf("ReservedCapacity = %d, %v", capacity, err)
+		}
+
+		sessions, err := d.GetWorkshopSessions(workshop)
+		if err != nil || len(sessions) != 1 {
+			t.Errorf("GetWorkshopSessions = %v, %v", sessions, err)
+		}
+
+		reservations, err := d.GetReservations()
+		if err != nil || len(reservations) != 2 || reservations[0][5].(int) != 1 {
+			t.Errorf("GetReservations = %v, %v", reservations, err)
+		}
+
+		err = d.EndWorkshop(workshop)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		deleted, err := d.DeleteReservation("RESV01")
+		if err != nil || !deleted {
+			t.Fatalf("DeleteReservation = %v, %v", deleted, err)
+		}
+
+		reserved, err = d.Reserved(now)
+		if err != nil || reserved != 0 {
+			t.Errorf("Reserved after ending = %d, %v", reserved, err)
+		}
+	})
+}
+
+func TestDbLogins(t *testing.T) {
+	dbTestBackends(t, func(t *testing.T, d dbBackend) {
+		err := d.NewLogin("token", "some-subject", time.Now().Unix()+3600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = d.NewLogin("expired", "some-subject", time.Now().Unix()-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			token string
+			want  string
+		}{
+			{"token", "some-subject"},
+			{"expired", ""},
+			{"missing", ""},
+		}
+
+		for _, test := range tests {
+			got, err := d.GetLogin(test.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != test.want {
+				t.Errorf("GetLogin(%q) = %q, want %q", test.token, got, test.want)
+			}
+		}
+
+		err = d.DeleteLogin("token")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := d.GetLogin("token")
+		if err != nil || got != "" {
+			t.Errorf("GetLogin after DeleteLogin = %q, %v", got, err)
+		}
+	})
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+type dbUpdate struct {
+	version int
+	run     func(d *dbSQL, tx *sql.Tx) error
+}
+
+// dbUpdates is the ordered list of schema migrations, the version of the
+// last entry is the schema version this server expects.
+//
+// Entries must never be modified or re-ordered once released, new schema
+// changes go into a new entry at the end of the list.
+var dbUpdates = []dbUpdate{
+	{version: 1, run: dbUpdateFromV0},
+	{version: 2, run: dbUpdateFromV1},
+	{version: 3, run: dbUpdateFromV2},
+	{version: 4, run: dbUpdateFromV3},
+	{version: 5, run: dbUpdateFromV4},
+	{version: 6, run: dbUpdateFromV5},
+	{version: 7, run: dbUpdateFromV6},
+	{version: 8, run: dbUpdateFromV7},
+	{version: 9, run: dbUpdateFromV8},
+	{version: 10, run: dbUpdateFromV9},
+	{version: 11, run: dbUpdateFromV10},
+	{version: 12, run: dbUpdateFromV11},
+	{version: 13, run: dbUpdateFromV12},
+	{version: 14, run: dbUpdateFromV13},
+	{version: 15, run: dbUpdateFromV14},
+	{version: 16, run: dbUpdateFromV15},
+	{version: 17, run: dbUpdateFromV16},
+}
+
+// ddl picks the statement matching the database driver.
+func (d *dbSQL) ddl(sqlite string, postgres string) string {
+	if d.driver == "postgres" {
+		return postgres
+	}
+
+	return sqlite
+}
+
+func (d *dbSQL) schemaVersion(tx *sql.Tx) (int, error) {
+	var version int
+
+	err := tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version;").Scan(&version)
+	if err != nil {
+		return -1, err
+	}
+
+	return version, nil
+}
+
+func (d *dbSQL) Update() error {
+	_, err := d.conn.Exec(`
+CREATE TABLE IF NOT EXISTS schema_version (
+    version INTEGER PRIMARY KEY NOT NULL,
+    updated_at BIGINT NOT NULL
+);
+`)
+	if err != nil {
+		return err
+	}
+
+	latest := dbUpdates[len(dbUpdates)-1].version
+
+	for _, update := range dbUpdates {
+		err := d.applyUpdate(update, latest)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Load the address hashing key
+	var ipKey string
+	err = d.conn.QueryRow("SELECT value FROM settings WHERE name='ip_hash_key';").Scan(&ipKey)
+	if err != nil {
+		return fmt.Errorf("Failed to load the address hashing key: %s", err)
+	}
+
+	d.ipKey = []byte(ipKey)
+
+	return nil
+}
+
+func (d *dbSQL) applyUpdate(update dbUpdate, latest int) error {
+	// Each update gets its own transaction
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Prevent other servers sharing the database from racing us
+	if d.driver == "postgres" {
+		_, err = tx.Exec("LOCK TABLE schema_version IN EXCLUSIVE MODE;")
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	current, err := d.schemaVersion(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if current > latest {
+		tx.Rollback()
+		return fmt.Errorf("The database schema (version %d) is newer than supported by this server (version %d)", current, latest)
+	}
+
+	if current >= update.version {
+		return tx.Rollback()
+	}
+
+	err = update.run(d, tx)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Failed to update the database schema to version %d: %s", update.version, err)
+	}
+
+	_, err = tx.Exec(d.q("INSERT INTO schema_version (version, updated_at) VALUES (?, ?);"), update.version, time.Now().Unix())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// dbUpdateFromV0 creates the initial schema. Databases created before schema
+// versioning was introduced already have those tables and are left untouched.
+func dbUpdateFromV0(d *dbSQL, tx *sql.Tx) error {
+	_, err := tx.Exec(d.ddl(`
+CREATE TABLE IF NOT EXISTS sessions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    uuid VARCHAR(36) NOT NULL,
+    status INTEGER NOT NULL,
+    container_name VARCHAR(64) NOT NULL,
+    container_ip VARCHAR(39) NOT NULL,
+    container_username VARCHAR(10) NOT NULL,
+    container_password VARCHAR(10) NOT NULL,
+    container_expiry INT NOT NULL,
+    request_date INT NOT NULL,
+    request_ip VARCHAR(39) NOT NULL,
+    request_terms VARCHAR(64) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS feedback (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    session_id INTEGER NOT NULL,
+    rating INTEGER,
+    email VARCHAR(255),
+    email_use INTEGER,
+    feedback TEXT,
+    FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
+);
+`, `
+CREATE TABLE IF NOT EXISTS sessions (
+    id BIGSERIAL PRIMARY KEY,
+    uuid VARCHAR(36) NOT NULL,
+    status INTEGER NOT NULL,
+    container_name VARCHAR(64) NOT NULL,
+    container_ip VARCHAR(39) NOT NULL,
+    container_username VARCHAR(10) NOT NULL,
+    container_password VARCHAR(10) NOT NULL,
+    container_expiry BIGINT NOT NULL,
+    request_date BIGINT NOT NULL,
+    request_ip VARCHAR(39) NOT NULL,
+    request_terms VARCHAR(64) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS feedback (
+    id BIGSERIAL PRIMARY KEY,
+    session_id BIGINT NOT NULL REFERENCES sessions (id) ON DELETE CASCADE,
+    rating INTEGER,
+    email VARCHAR(255),
+    email_use INTEGER,
+    feedback TEXT
+);
+`))
+	return err
+}
+
+func dbUpdateFromV1(d *dbSQL, tx *sql.Tx) error {
+	_, err := tx.Exec(d.ddl(`
+CREATE TABLE IF NOT EXISTS bans (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    ip VARCHAR(39) NOT NULL,
+    reason TEXT NOT NULL,
+    date INT NOT NULL
+);
+`, `
+CREATE TABLE IF NOT EXISTS bans (
+    id BIGSERIAL PRIMARY KEY,
+    ip VARCHAR(39) NOT NULL,
+    reason TEXT NOT NULL,
+    date BIGINT NOT NULL
+);
+`))
+	return err
+}
+
+// dbUpdateFromV2 adds what's needed for the data retention job: a keyed hash of
+// the client address used for statistics and a flag for anonymized records.
+func dbUpdateFromV2(d *dbSQL, tx *sql.Tx) error {
+	_, err := tx.Exec(d.ddl(`
+CREATE TABLE settings (
+    name VARCHAR(255) PRIMARY KEY NOT NULL,
+    value TEXT NOT NULL
+);
+
+ALTER TABLE sessions ADD COLUMN request_ip_hash VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN anonymized INTEGER NOT NULL DEFAULT 0;
+`, `
+CREATE TABLE settings (
+    name VARCHAR(255) PRIMARY KEY,
+    value TEXT NOT NULL
+);
+
+ALTER TABLE sessions ALTER COLUMN request_ip TYPE VARCHAR(64);
+ALTER TABLE sessions ADD COLUMN request_ip_hash VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN anonymized INTEGER NOT NULL DEFAULT 0;
+`))
+	if err != nil {
+		return err
+	}
+
+	// Generate the address hashing key
+	buf := make([]byte, 32)
+	_, err = rand.Read(buf)
+	if err != nil {
+		return err
+	}
+
+	d.ipKey = []byte(hex.EncodeToString(buf))
+
+	_, err = tx.Exec(d.q("INSERT INTO settings (name, value) VALUES ('ip_hash_key', ?);"), string(d.ipKey))
+	if err != nil {
+		return err
+	}
+
+	// Hash the existing records
+	rows, err := tx.Query("SELECT id, request_ip FROM sessions;")
+	if err != nil {
+		return err
+	}
+
+	hashes := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var ip string
+
+		err = rows.Scan(&id, &ip)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		hashes[id] = d.hashIP(ip)
+	}
+	rows.Close()
+
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	for id, hash := range hashes {
+		_, err = tx.Exec(d.q("UPDATE sessions SET request_ip_hash=? WHERE id=?;"), hash, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dbUpdateFromV3 wipes the container passwords which are no longer stored.
+func dbUpdateFromV3(d *dbSQL, tx *sql.Tx) error {
+	_, err := tx.Exec("UPDATE sessions SET container_password='';")
+	return err
+}
+
+func dbUpdateFromV4(d *dbSQL, tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE sessions ADD COLUMN transfer_bytes BIGINT NOT NULL DEFAULT 0;")
+	return err
+}
+
+func dbUpdateFromV5(d *dbSQL, tx *sql.Tx) error {
+	_, err := tx.Exec(d.ddl(`
+CREATE TABLE events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    session_id INTEGER NOT NULL,
+    date INT NOT NULL,
+    rule VARCHAR(255) NOT NULL,
+    action VARCHAR(255) NOT NULL,
+    reason TEXT NOT NULL,
+    FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
+);
+`, `
+CREATE TABLE events (
+    id BIGSERIAL PRIMARY KEY,
+    session_id BIGINT NOT NULL REFERENCES sessions (id) ON DELETE CASCADE,
+    date BIGINT NOT NULL,
+    rule VARCHAR(255) NOT NULL,
+    action VARCHAR(255) NOT NULL,
+    reason TEXT NOT NULL
+);
+`))
+	return err
+}
+
+func dbUpdateFromV6(d *dbSQL, tx *sql.Tx) error {
+	_, err := tx.Exec(d.ddl(`
+CREATE TABLE snapshots (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    session_id INTEGER NOT NULL,
+    name VARCHAR(64) NOT NULL,
+    date INT NOT NULL,
+    size INT NOT NULL,
+    FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
+);
+`, `
+CREATE TABLE snapshots (
+    id BIGSERIAL PRIMARY KEY,
+    session_id BIGINT NOT NULL REFERENCES sessions (id) ON DELETE CASCADE,
+    name VARCHAR(64) NOT NULL,
+    date BIGINT NOT NULL,
+    size BIGINT NOT NULL
+);
+`))
+	return err
+}
+
+func dbUpdateFromV7(d *dbSQL, tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE sessions ADD COLUMN last_reset BIGINT NOT NULL DEFAULT 0;")
+	return err
+}
+
+func dbUpdateFromV8(d *dbSQL, tx *sql.Tx) error {
+	_, err := tx.Exec(d.ddl(`
+ALTER TABLE sessions ADD COLUMN request_user VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE bans ADD COLUMN user_id VARCHAR(255) NOT NULL DEFAULT '';
+
+CREATE TABLE logins (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    token VARCHAR(64) NOT NULL,
+    user_id VARCHAR(255) NOT NULL,
+    expiry INT NOT NULL,
+    UNIQUE (token)
+);
+`, `
+ALTER TABLE sessions ADD COLUMN request_user VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE bans ADD COLUMN user_id VARCHAR(255) NOT NULL DEFAULT '';
+
+CREATE TABLE logins (
+    id BIGSERIAL PRIMARY KEY,
+    token VARCHAR(64) NOT NULL,
+    user_id VARCHAR(255) NOT NULL,
+    expiry BIGINT NOT NULL,
+    UNIQUE (token)
+);
+`))
+	return err
+}
+
+func dbUpdateFromV9(d *dbSQL, tx *sql.Tx) error {
+	_, err := tx.Exec(d.ddl(`
+ALTER TABLE sessions ADD COLUMN environment VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN request_token INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE api_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    token VARCHAR(64) NOT NULL,
+    quota_sessions INTEGER NOT NULL,
+    environments TEXT NOT NULL,
+    max_lifetime INTEGER NOT NULL,
+    created INT NOT NULL,
+    revoked INT NOT NULL,
+    UNIQUE (name),
+    UNIQUE (token)
+);
+`, `
+ALTER TABLE sessions ADD COLUMN environment VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN request_token BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE api_tokens (
+    id BIGSERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    token VARCHAR(64) NOT NULL,
+    quota_sessions INTEGER NOT NULL,
+    environments TEXT NOT NULL,
+    max_lifetime INTEGER NOT NULL,
+    created BIGINT NOT NULL,
+    revoked BIGINT NOT NULL,
+    UNIQUE (name),
+    UNIQUE (token)
+);
+`))
+	return err
+}
+
+func dbUpdateFromV10(d *dbSQL, tx *sql.Tx) error {
+	_, err := tx.Exec(d.ddl(`
+ALTER TABLE sessions ADD COLUMN request_workshop INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE workshops (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    code VARCHAR(16) NOT NULL,
+    secret VARCHAR(64) NOT NULL,
+    environment VARCHAR(255) NOT NULL,
+    capacity INTEGER NOT NULL,
+    start_date INT NOT NULL,
+    end_date INT NOT NULL,
+    ended INT NOT NULL,
+    UNIQUE (code)
+);
+`, `
+ALTER TABLE sessions ADD COLUMN request_workshop BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE workshops (
+    id BIGSERIAL PRIMARY KEY,
+    code VARCHAR(16) NOT NULL,
+    secret VARCHAR(64) NOT NULL,
+    environment VARCHAR(255) NOT NULL,
+    capacity INTEGER NOT NULL,
+    start_date BIGINT NOT NULL,
+    end_date BIGINT NOT NULL,
+    ended BIGINT NOT NULL,
+    UNIQUE (code)
+);
+`))
+	return err
+}
+
+func dbUpdateFromV11(d *dbSQL, tx *sql.Tx) error {
+	_, err := tx.Exec(d.ddl(`
+ALTER TABLE sessions ADD COLUMN request_reservation INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE reservations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    code VARCHAR(16) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    slots INTEGER NOT NULL,
+    start_date INT NOT NULL,
+    end_date INT NOT NULL,
+    UNIQUE (code)
+);
+`, `
+ALTER TABLE sessions ADD COLUMN request_reservation BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE reservations (
+    id BIGSERIAL PRIMARY KEY,
+    code VARCHAR(16) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    slots INTEGER NOT NULL,
+    start_date BIGINT NOT NULL,
+    end_date BIGINT NOT NULL,
+    UNIQUE (code)
+);
+`))
+	return err
+}
+
+func dbUpdateFromV12(d *dbSQL, tx *sql.Tx) error {
+	_, err := tx.Exec(d.ddl(`
+CREATE TABLE tutorial_progress (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    session_id INTEGER NOT NULL,
+    tutorial VARCHAR(255) NOT NULL,
+    step INTEGER NOT NULL,
+    updated INT NOT NULL,
+    UNIQUE (session_id, tutorial),
+    FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
+);
+`, `
+CREATE TABLE tutorial_progress (
+    id BIGSERIAL PRIMARY KEY,
+    session_id BIGINT NOT NULL REFERENCES sessions (id) ON DELETE CASCADE,
+    tutorial VARCHAR(255) NOT NULL,
+    step INTEGER NOT NULL,
+    updated BIGINT NOT NULL,
+    UNIQUE (session_id, tutorial)
+);
+`))
+	return err
+}
+
+func dbUpdateFromV13(d *dbSQL, tx *sql.Tx) error {
+	_, err := tx.Exec(d.ddl(`
+ALTER TABLE sessions ADD COLUMN idle_time INTEGER NOT NULL DEFAULT 0;
+`, `
+ALTER TABLE sessions ADD COLUMN idle_time BIGINT NOT NULL DEFAULT 0;
+`))
+	return err
+}
+
+func dbUpdateFromV14(d *dbSQL, tx *sql.Tx) error {
+	_, err := tx.Exec(d.ddl(`
+CREATE TABLE console_audit (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    session_id INTEGER NOT NULL,
+    date INT NOT NULL,
+    data TEXT NOT NULL,
+    FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
+);
+`, `
+CREATE TABLE console_audit (
+    id BIGSERIAL PRIMARY KEY,
+    session_id BIGINT NOT NULL REFERENCES sessions (id) ON DELETE CASCADE,
+    date BIGINT NOT NULL,
+    data TEXT NOT NULL
+);
+`))
+	return err
+}
+
+// dbUpdateFromV15 adds the token used to reach a session's services through
+// the proxy, so the session id doesn't need to be handed out in URLs.
+func dbUpdateFromV15(d *dbSQL, tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE sessions ADD COLUMN proxy_token VARCHAR(64) NOT NULL DEFAULT '';
+CREATE INDEX sessions_proxy_token ON sessions (proxy_token);
+`)
+	return err
+}
+
+// dbUpdateFromV16 adds the time of the last console activity, shared by all
+// the servers using the database to tell idle sessions.
+func dbUpdateFromV16(d *dbSQL, tx *sql.Tx) error {
+	_, err := tx.Exec(d.ddl(`
+ALTER TABLE sessions ADD COLUMN console_activity INTEGER NOT NULL DEFAULT 0;
+`, `
+ALTER TABLE sessions ADD COLUMN console_activity BIGINT NOT NULL DEFAULT 0;
+`))
+	return err
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dbTestBaseline is the schema created by the server before schema
+// versioning was introduced, back when only SQLite was supported.
+const dbTestBaseline = `
+CREATE TABLE IF NOT EXISTS sessions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    uuid VARCHAR(36) NOT NULL,
+    status INTEGER NOT NULL,
+    container_name VARCHAR(64) NOT NULL,
+    container_ip VARCHAR(39) NOT NULL,
+    container_username VARCHAR(10) NOT NULL,
+    container_password VARCHAR(10) NOT NULL,
+    container_expiry INT NOT NULL,
+    request_date INT NOT NULL,
+    request_ip VARCHAR(39) NOT NULL,
+    request_terms VARCHAR(64) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS feedback (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    session_id INTEGER NOT NULL,
+    rating INTEGER,
+    email VARCHAR(255),
+    email_use INTEGER,
+    feedback TEXT,
+    FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
+);
+`
+
+func TestDbUpdateFromBaseline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxd-demo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "lxd-demo.sqlite3")
+
+	// Populate the database the way the baseline server would have
+	conn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = conn.Exec(dbTestBaseline)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	sessions := []struct {
+		uuid   string
+		status int
+		ip     string
+	}{
+		{"session-1", 0, "10.1.1.1"},
+		{"session-2", 1, "10.1.1.1"},
+		{"session-3", 1, "2001:db8::1"},
+	}
+
+	for _, session := range sessions {
+		_, err = conn.Exec("INSERT INTO sessions (status, uuid, container_name, container_ip, container_username, container_password, container_expiry, request_date, request_ip, request_terms) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);",
+			session.status, session.uuid, "tryit-"+session.uuid, "10.0.0.1", "user", "secret", now+3600, now, session.ip, "terms")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = conn.Exec("INSERT INTO feedback (session_id, rating, email, email_use, feedback) VALUES (2, 5, 'user@example.com', 1, 'great');")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Close()
+
+	// Upgrade it
+	d, err := dbSqliteOpen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.conn.Close()
+
+	err = d.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var version int
+	err = d.conn.QueryRow("SELECT MAX(version) FROM schema_version;").Scan(&version)
+	if err != nil || version != dbUpdates[len(dbUpdates)-1].version {
+		t.Fatalf("Schema version after Update = %d, %v", version, err)
+	}
+
+	// The sessions are still there, with their addresses hashed
+	for _, session := range sessions {
+		var ip string
+		var ipHash string
+
+		err = d.conn.QueryRow("SELECT request_ip, request_ip_hash FROM sessions WHERE uuid=?;", session.uuid).Scan(&ip, &ipHash)
+		if err != nil {
+			t.Fatalf("Session %s didn't survive the upgrade: %s", session.uuid, err)
+		}
+
+		if ip != session.ip {
+			t.Errorf("Session %s has address %q, want %q", session.uuid, ip, session.ip)
+		}
+
+		if ipHash == "" || ipHash != d.hashIP(session.ip) {
+			t.Errorf("Session %s has address hash %q, want %q", session.uuid, ipHash, d.hashIP(session.ip))
+		}
+	}
+
+	sessionId, _, _, _, _, err := d.GetContainer("session-1", true)
+	if err != nil || sessionId != 1 {
+		t.Errorf("GetContainer after the upgrade = %d, %v", sessionId, err)
+	}
+
+	_, rating, email, _, message, err := d.GetFeedback(2)
+	if err != nil || rating != 5 || email != "user@example.com" || message != "great" {
+		t.Errorf("GetFeedback after the upgrade = %d, %s, %s, %v", rating, email, message, err)
+	}
+
+	unique, err := d.GetStats("total", true, nil)
+	if err != nil || unique != 2 {
+		t.Errorf("GetStats after the upgrade = %d, %v", unique, err)
+	}
+
+	// Running it again is a no-op
+	err = d.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbUpdateNewerSchema(t *testing.T) {
+	latest := dbUpdates[len(dbUpdates)-1].version
+
+	dbTestOpen(t, func(t *testing.T, d dbBackend, conn *sql.DB) {
+		err := d.Update()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = conn.Exec(fmt.Sprintf("INSERT INTO schema_version (version, updated_at) VALUES (%d, %d);", latest+1, time.Now().Unix()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = d.Update()
+		if err == nil {
+			t.Fatal("Update accepted a newer schema")
+		}
+
+		want := fmt.Sprintf("The database schema (version %d) is newer than supported by this server (version %d)", latest+1, latest)
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Update returned %q, want %q", err, want)
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+)
+
+type environment struct {
+	Name      string   `yaml:"-"`
+	Container string   `yaml:"container"`
+	Image     string   `yaml:"image"`
+	Profiles  []string `yaml:"profiles"`
+	Command   []string `yaml:"command"`
+
+	Console   *consoleConfig   `yaml:"console"`
+	Provision *provisionConfig `yaml:"provision"`
+}
+
+// configEnvironment returns the named environment, an empty name being the
+// default environment described by the top-level configuration keys.
+// Environments inherit the default profiles, command, console settings and
+// provisioning unless overridden.
+func configEnvironment(name string) (environment, error) {
+	env := environment{
+		Name:      "default",
+		Container: config.Container,
+		Image:     config.Image,
+		Profiles:  config.Profiles,
+		Command:   config.Command,
+		Console:   &config.Console,
+		Provision: &config.Provision,
+	}
+
+	if name == "" {
+		return env, nil
+	}
+
+	entry, ok := config.Environments[name]
+	if !ok {
+		return environment{}, fmt.Errorf("Unknown environment: %s", name)
+	}
+
+	env.Name = name
+
+	if entry.Container != "" || entry.Image != "" {
+		env.Container = entry.Container
+		env.Image = entry.Image
+	}
+
+	if entry.Profiles != nil {
+		env.Profiles = entry.Profiles
+	}
+
+	if entry.Command != nil {
+		env.Command = entry.Command
+	}
+
+	if entry.Console != nil {
+		env.Console = entry.Console
+	}
+
+	if entry.Provision != nil {
+		env.Provision = entry.Provision
+	}
+
+	return env, nil
+}
+
+func environmentsValidate() error {
+	err := consoleValidate(config.Console)
+	if err != nil {
+		return err
+	}
+
+	err = provisionValidate(config.Provision)
+	if err != nil {
+		return err
+	}
+
+	for name, entry := range config.Environments {
+		if entry.Console != nil {
+			err := consoleValidate(*entry.Console)
+			if err != nil {
+				return fmt.Errorf("Invalid environment %s: %s", name, err)
+			}
+		}
+
+		if entry.Provision != nil {
+			err := provisionValidate(*entry.Provision)
+			if err != nil {
+				return fmt.Errorf("Invalid environment %s: %s", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// sessionEnvironment returns the environment a session was created from.
+func sessionEnvironment(sessionId int64) (environment, error) {
+	name, err := db.GetEnvironment(sessionId)
+	if err != nil {
+		return environment{}, err
+	}
+
+	return configEnvironment(name)
+}
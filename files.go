@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/lxc/lxd/client"
+)
+
+func restFileHandler(w http.ResponseWriter, r *http.Request) {
+	if len(config.ServerFilePaths) == 0 {
+		http.Error(w, "File transfers are disabled", 400)
+		return
+	}
+
+	if r.Method == "GET" {
+		restFileGetHandler(w, r)
+		return
+	}
+
+	if r.Method == "POST" {
+		restFilePostHandler(w, r)
+		return
+	}
+
+	if r.Method == "OPTIONS" {
+		origin := r.Header.Get("Origin")
+		if origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		}
+
+		return
+	}
+
+	http.Error(w, "Not implemented", 501)
+}
+
+// fileError is a file request failure, reported to the client as is.
+type fileError struct {
+	status int
+	msg    string
+}
+
+func (e fileError) Error() string {
+	return e.msg
+}
+
+// fileHTTPError reports a failed file request to the client.
+func fileHTTPError(w http.ResponseWriter, err error) {
+	fileErr, ok := err.(fileError)
+	if !ok {
+		fmt.Printf("File transfer failed: %s\n", err)
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	http.Error(w, fileErr.msg, fileErr.status)
+}
+
+// fileTarget is the session and file a request is about, along with the
+// largest file that can be transferred in bytes.
+type fileTarget struct {
+	sessionId         int64
+	containerName     string
+	containerUsername string
+	path              string
+	maxSize           int64
+}
+
+// fileRequest validates the session and path arguments of a file request.
+func fileRequest(r *http.Request) (fileTarget, error) {
+	// Get the id argument
+	id := r.FormValue("id")
+	if id == "" {
+		return fileTarget{}, fileError{400, "Missing session id"}
+	}
+
+	// Get the container
+	sessionId, containerName, _, containerUsername, _, err := db.GetContainer(id, true)
+	if err != nil || sessionId == -1 {
+		return fileTarget{}, fileError{404, "Session not found"}
+	}
+
+	// Validate the path
+	filePath := r.FormValue("path")
+	if filePath == "" || !strings.HasPrefix(filePath, "/") {
+		return fileTarget{}, fileError{400, "Invalid path"}
+	}
+
+	filePath = path.Clean(filePath)
+
+	allowed := false
+	for _, prefix := range config.ServerFilePaths {
+		prefix = path.Clean(prefix)
+		if filePath == prefix || strings.HasPrefix(filePath, strings.TrimSuffix(prefix, "/")+"/") {
+			allowed = true
+			break
+		}
+	}
+
+	if !allowed {
+		return fileTarget{}, fileError{403, "Path not allowed"}
+	}
+
+	// Figure out how much can still be transferred
+	maxSize := int64(config.QuotaFileSize) * 1024 * 1024
+	if config.QuotaTransfer > 0 {
+		transferred, err := db.GetTransfer(sessionId)
+		if err != nil {
+			return fileTarget{}, err
+		}
+
+		remaining := int64(config.QuotaTransfer)*1024*1024 - transferred
+		if remaining < 0 {
+			remaining = 0
+		}
+
+		if remaining < maxSize {
+			maxSize = remaining
+		}
+	}
+
+	return fileTarget{
+		sessionId:         sessionId,
+		containerName:     containerName,
+		containerUsername: containerUsername,
+		path:              filePath,
+		maxSize:           maxSize,
+	}, nil
+}
+
+// fileReserve accounts for a transfer of up to size bytes ahead of it, so
+// that concurrent transfers can't go over the session's quota. Whatever
+// doesn't get transferred is to be given back with fileRelease.
+func fileReserve(sessionId int64, size int64) (bool, error) {
+	if config.QuotaTransfer <= 0 {
+		return true, db.AddTransfer(sessionId, size)
+	}
+
+	return db.ReserveTransfer(sessionId, size, int64(config.QuotaTransfer)*1024*1024)
+}
+
+func fileRelease(sessionId int64, size int64) {
+	if size <= 0 {
+		return
+	}
+
+	err := db.AddTransfer(sessionId, -size)
+	if err != nil {
+		fmt.Printf("Failed to release transfer quota: %s\n", err)
+	}
+}
+
+// fileRead reads up to limit bytes, failing if there's more.
+func fileRead(r io.Reader, limit int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("File too large")
+	}
+
+	return data, nil
+}
+
+func restFileGetHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	target, err := fileRequest(r)
+	if err != nil {
+		fileHTTPError(w, err)
+		return
+	}
+
+	// Get the file
+	content, resp, err := lxdDaemon.GetContainerFile(target.containerName, target.path)
+	if err != nil {
+		http.Error(w, "File not found", 404)
+		return
+	}
+	defer content.Close()
+
+	if resp.Type != "file" {
+		http.Error(w, "Not a file", 400)
+		return
+	}
+
+	reserved, err := fileReserve(target.sessionId, target.maxSize)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	if !reserved {
+		http.Error(w, "File size or transfer quota exceeded", 413)
+		return
+	}
+
+	data, err := fileRead(content, target.maxSize)
+	if err != nil {
+		fileRelease(target.sessionId, target.maxSize)
+		http.Error(w, "File size or transfer quota exceeded", 413)
+		return
+	}
+
+	fileRelease(target.sessionId, target.maxSize-int64(len(data)))
+
+	// Return to the client
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(target.path)))
+	w.Write(data)
+}
+
+func restFilePostHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	target, err := fileRequest(r)
+	if err != nil {
+		fileHTTPError(w, err)
+		return
+	}
+
+	// Uploads belong to the console user, so they can be edited from the console
+	env, err := sessionEnvironment(target.sessionId)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	_, uid, gid, _, err := consoleUser(env, target.containerName, target.containerUsername)
+	if err != nil {
+		fmt.Printf("Unable to upload to %s: %s\n", target.containerName, err)
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	reserved, err := fileReserve(target.sessionId, target.maxSize)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	if !reserved {
+		http.Error(w, "File size or transfer quota exceeded", 413)
+		return
+	}
+
+	data, err := fileRead(r.Body, target.maxSize)
+	if err != nil {
+		fileRelease(target.sessionId, target.maxSize)
+		http.Error(w, "File size or transfer quota exceeded", 413)
+		return
+	}
+
+	// Push the file
+	args := lxd.ContainerFileArgs{
+		Content:   bytes.NewReader(data),
+		UID:       int64(uid),
+		GID:       int64(gid),
+		Mode:      0644,
+		Type:      "file",
+		WriteMode: "overwrite",
+	}
+
+	err = lxdDaemon.CreateContainerFile(target.containerName, target.path, args)
+	if err != nil {
+		fileRelease(target.sessionId, target.maxSize)
+		http.Error(w, "Unable to write the file", 500)
+		return
+	}
+
+	fileRelease(target.sessionId, target.maxSize-int64(len(data)))
+}
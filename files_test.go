@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileRead(t *testing.T) {
+	tests := []struct {
+		content string
+		limit   int64
+		valid   bool
+	}{
+		{"", 0, true},
+		{"a", 0, false},
+		{"hello", 5, true},
+		{"hello", 4, false},
+		{"hello", 1024, true},
+	}
+
+	for _, test := range tests {
+		data, err := fileRead(strings.NewReader(test.content), test.limit)
+		if test.valid && (err != nil || string(data) != test.content) {
+			t.Errorf("fileRead(%q, %d) = %q, %v", test.content, test.limit, data, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("fileRead(%q, %d) didn't fail", test.content, test.limit)
+		}
+	}
+}
+
+func TestFilePost(t *testing.T) {
+	defer dbTestGlobal(t)()
+
+	daemon := &lxdTestServer{}
+	lxdDaemon = daemon
+	defer func() { lxdDaemon = nil }()
+
+	config = serverConfig{
+		QuotaFileSize:   1,
+		QuotaTransfer:   2,
+		ServerFilePaths: []string{"/home"},
+		Console:         consoleConfig{User: "session", UID: 1000, GID: 1000},
+	}
+
+	sessionId := dbTestSession(t, db, "session-1", "10.1.1.1", time.Now().Unix())
+
+	tests := []struct {
+		name   string
+		query  string
+		size   int
+		status int
+	}{
+		{"valid", "id=session-1&path=/home/user/notes.txt", 1024, 200},
+		{"no session", "path=/home/user/notes.txt", 1024, 400},
+		{"unknown session", "id=session-2&path=/home/user/notes.txt", 1024, 404},
+		{"relative path", "id=session-1&path=notes.txt", 1024, 400},
+		{"path not allowed", "id=session-1&path=/home/../etc/passwd", 1024, 403},
+		{"too large", "id=session-1&path=/home/user/large", 1024*1024 + 1, 413},
+	}
+
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		restFileHandler(rec, httptest.NewRequest("POST", "/1.0/file?"+test.query, strings.NewReader(strings.Repeat("a", test.size))))
+
+		if rec.Code != test.status {
+			t.Errorf("%s: got status %d, want %d: %s", test.name, rec.Code, test.status, rec.Body.String())
+		}
+	}
+
+	// Uploads belong to the console user
+	args, ok := daemon.files["tryit-session-1/home/user/notes.txt"]
+	if !ok || args.UID != 1000 || args.GID != 1000 {
+		t.Errorf("File written as %d:%d (%v)", args.UID, args.GID, ok)
+	}
+
+	// Only the uploaded data counts against the transfer quota
+	transferred, err := db.GetTransfer(sessionId)
+	if err != nil || transferred != 1024 {
+		t.Errorf("GetTransfer = %d, %v", transferred, err)
+	}
+}
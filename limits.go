@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/api"
+)
+
+func limitsValidate() error {
+	if config.QuotaCPUAllowance < 0 || config.QuotaCPUAllowance > 100 {
+		return fmt.Errorf("Invalid quota_cpu_allowance: %d", config.QuotaCPUAllowance)
+	}
+
+	if config.QuotaCPUPriority < 0 || config.QuotaCPUPriority > 10 {
+		return fmt.Errorf("Invalid quota_cpu_priority: %d", config.QuotaCPUPriority)
+	}
+
+	if !shared.StringInSlice(config.QuotaRAMEnforce, []string{"", "hard", "soft"}) {
+		return fmt.Errorf("Invalid quota_ram_enforce: %s", config.QuotaRAMEnforce)
+	}
+
+	for key, value := range map[string]string{"quota_disk_read": config.QuotaDiskRead, "quota_disk_write": config.QuotaDiskWrite} {
+		if value != "" && !strings.HasSuffix(value, "iops") && !strings.HasSuffix(value, "B") {
+			return fmt.Errorf("Invalid %s, expected a rate (e.g. 20MB) or iops value (e.g. 500iops): %s", key, value)
+		}
+	}
+
+	return nil
+}
+
+// limitsConfig adds the resource limits to the container configuration.
+func limitsConfig(ctConfig map[string]string) {
+	if config.QuotaCPU > 0 {
+		ctConfig["limits.cpu"] = fmt.Sprintf("%d", config.QuotaCPU)
+	}
+
+	if config.QuotaCPUAllowance > 0 {
+		ctConfig["limits.cpu.allowance"] = fmt.Sprintf("%d%%", config.QuotaCPUAllowance)
+	}
+
+	if config.QuotaCPUPriority > 0 {
+		ctConfig["limits.cpu.priority"] = fmt.Sprintf("%d", config.QuotaCPUPriority)
+	}
+
+	if config.QuotaRAM > 0 {
+		ctConfig["limits.memory"] = fmt.Sprintf("%dMB", config.QuotaRAM)
+	}
+
+	if config.QuotaRAMEnforce != "" {
+		ctConfig["limits.memory.enforce"] = config.QuotaRAMEnforce
+	}
+
+	if config.QuotaRAMSwap != nil {
+		ctConfig["limits.memory.swap"] = fmt.Sprintf("%t", *config.QuotaRAMSwap)
+	}
+
+	if config.QuotaProcesses > 0 {
+		ctConfig["limits.processes"] = fmt.Sprintf("%d", config.QuotaProcesses)
+	}
+
+	if config.QuotaOpenFiles > 0 {
+		ctConfig["limits.kernel.nofile"] = fmt.Sprintf("%d", config.QuotaOpenFiles)
+	}
+}
+
+// limitsConfigureDevices applies the disk limits to the container's root device.
+func limitsConfigureDevices(ct *api.Container) {
+	if config.QuotaDisk == 0 && config.QuotaDiskRead == "" && config.QuotaDiskWrite == "" {
+		return
+	}
+
+	root := map[string]string{"type": "disk", "path": "/"}
+	for k, v := range ct.ExpandedDevices["root"] {
+		root[k] = v
+	}
+
+	if config.QuotaDisk > 0 {
+		root["size"] = fmt.Sprintf("%dGB", config.QuotaDisk)
+	}
+
+	if config.QuotaDiskRead != "" {
+		root["limits.read"] = config.QuotaDiskRead
+	}
+
+	if config.QuotaDiskWrite != "" {
+		root["limits.write"] = config.QuotaDiskWrite
+	}
+
+	ct.Devices["root"] = root
+}
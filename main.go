@@ -9,10 +9,12 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/lxc/lxd/client"
+	"github.com/lxc/lxd/shared"
 	"gopkg.in/fsnotify.v0"
 	"gopkg.in/yaml.v2"
 )
@@ -22,31 +24,85 @@ var lxdDaemon lxd.ContainerServer
 var config serverConfig
 
 type serverConfig struct {
-	Container string   `yaml:"container"`
-	Image     string   `yaml:"image"`
-	Profiles  []string `yaml:"profiles"`
-	Command   []string `yaml:"command"`
+	Container      string                 `yaml:"container"`
+	ContainerName  string                 `yaml:"container_name"`
+	Image          string                 `yaml:"image"`
+	Profiles       []string               `yaml:"profiles"`
+	Command        []string               `yaml:"command"`
+	CloudInit      string                 `yaml:"cloud_init"`
+	Console        consoleConfig          `yaml:"console"`
+	Database       string                 `yaml:"database"`
+	Environments   map[string]environment `yaml:"environments"`
+	PasswordLength int                    `yaml:"password_length"`
+	Provision      provisionConfig        `yaml:"provision"`
 
 	Feedback        bool `yaml:"feedback"`
 	FeedbackTimeout int  `yaml:"feedback_timeout"`
 
-	QuotaCPU       int `yaml:"quota_cpu"`
-	QuotaDisk      int `yaml:"quota_disk"`
-	QuotaProcesses int `yaml:"quota_processes"`
-	QuotaRAM       int `yaml:"quota_ram"`
-	QuotaSessions  int `yaml:"quota_sessions"`
-	QuotaTime      int `yaml:"quota_time"`
-
+	MonitorInterval int           `yaml:"monitor_interval"`
+	MonitorRules    []monitorRule `yaml:"monitor_rules"`
+
+	NetworkACL         string        `yaml:"network_acl"`
+	NetworkEgress      string        `yaml:"network_egress"`
+	NetworkEgressRules []networkRule `yaml:"network_egress_rules"`
+
+	OIDCClientID     string `yaml:"oidc_client_id"`
+	OIDCClientSecret string `yaml:"oidc_client_secret"`
+	OIDCIssuer       string `yaml:"oidc_issuer"`
+	OIDCRedirectURL  string `yaml:"oidc_redirect_url"`
+
+	QuotaCPU            int    `yaml:"quota_cpu"`
+	QuotaCPUAllowance   int    `yaml:"quota_cpu_allowance"`
+	QuotaCPUPriority    int    `yaml:"quota_cpu_priority"`
+	QuotaDisk           int    `yaml:"quota_disk"`
+	QuotaDiskRead       string `yaml:"quota_disk_read"`
+	QuotaDiskWrite      string `yaml:"quota_disk_write"`
+	QuotaFileSize       int    `yaml:"quota_file_size"`
+	QuotaIdle           int    `yaml:"quota_idle"`
+	QuotaIdleGrace      int    `yaml:"quota_idle_grace"`
+	QuotaNetworkIngress int    `yaml:"quota_network_ingress"`
+	QuotaNetworkEgress  int    `yaml:"quota_network_egress"`
+	QuotaOpenFiles      int    `yaml:"quota_open_files"`
+	QuotaProcesses      int    `yaml:"quota_processes"`
+	QuotaRAM            int    `yaml:"quota_ram"`
+	QuotaRAMEnforce     string `yaml:"quota_ram_enforce"`
+	QuotaRAMSwap        *bool  `yaml:"quota_ram_swap"`
+	QuotaResetInterval  int    `yaml:"quota_reset_interval"`
+	QuotaSessions       int    `yaml:"quota_sessions"`
+	QuotaSnapshots      int    `yaml:"quota_snapshots"`
+	QuotaTime           int    `yaml:"quota_time"`
+	QuotaTransfer       int    `yaml:"quota_transfer"`
+
+	RetentionAnonymize int    `yaml:"retention_anonymize"`
+	RetentionDelete    int    `yaml:"retention_delete"`
+	RetentionIPMode    string `yaml:"retention_ip_mode"`
+	RetentionIPv4Mask  int    `yaml:"retention_ipv4_mask"`
+	RetentionIPv6Mask  int    `yaml:"retention_ipv6_mask"`
+
+	ServerAdminKeys      []string `yaml:"server_admin_keys"`
 	ServerAddr           string   `yaml:"server_addr"`
 	ServerBannedIPs      []string `yaml:"server_banned_ips"`
+	ServerBannedUsers    []string `yaml:"server_banned_users"`
+	ServerConsoleAudit   string   `yaml:"server_console_audit"`
 	ServerConsoleOnly    bool     `yaml:"server_console_only"`
 	ServerContainersMax  int      `yaml:"server_containers_max"`
 	ServerIPv6Only       bool     `yaml:"server_ipv6_only"`
+	ServerFilePaths      []string `yaml:"server_file_paths"`
 	ServerMaintenance    bool     `yaml:"server_maintenance"`
+	ServerProxyBandwidth int      `yaml:"server_proxy_bandwidth"`
+	ServerProxyDomain    string   `yaml:"server_proxy_domain"`
+	ServerProxyPorts     []int    `yaml:"server_proxy_ports"`
+	ServerSSHAddr        string   `yaml:"server_ssh_addr"`
+	ServerSSHKeysOnly    bool     `yaml:"server_ssh_keys_only"`
 	ServerStatisticsKeys []string `yaml:"server_statistics_keys"`
 	ServerTerms          string   `yaml:"server_terms"`
 
-	serverTermsHash string
+	Tutorials string `yaml:"tutorials"`
+
+	cloudInitTemplate     *template.Template
+	containerNameTemplate *template.Template
+	serverTermsHash       string
+	tutorials             map[string]tutorial
 }
 
 type statusCode int
@@ -55,12 +111,15 @@ const (
 	serverOperational statusCode = 0
 	serverMaintenance statusCode = 1
 
-	containerStarted      statusCode = 0
-	containerInvalidTerms statusCode = 1
-	containerServerFull   statusCode = 2
-	containerQuotaReached statusCode = 3
-	containerUserBanned   statusCode = 4
-	containerUnknownError statusCode = 5
+	containerStarted         statusCode = 0
+	containerInvalidTerms    statusCode = 1
+	containerServerFull      statusCode = 2
+	containerQuotaReached    statusCode = 3
+	containerUserBanned      statusCode = 4
+	containerUnknownError    statusCode = 5
+	containerLoginNeeded     statusCode = 6
+	containerProvisionFailed statusCode = 7
+	containerInvalidToken    statusCode = 8
 )
 
 func main() {
@@ -93,11 +152,106 @@ func parseConfig() error {
 		config.Command = []string{"bash"}
 	}
 
+	if config.ContainerName == "" {
+		config.ContainerName = "tryit-{{.Adjective}}-{{.Name}}"
+	}
+
+	config.containerNameTemplate, err = template.New("container_name").Parse(config.ContainerName)
+	if err != nil {
+		return fmt.Errorf("Invalid container_name template: %s", err)
+	}
+
+	config.cloudInitTemplate, err = cloudInitLoad()
+	if err != nil {
+		return err
+	}
+
+	if config.PasswordLength == 0 {
+		config.PasswordLength = 16
+	}
+
+	if config.PasswordLength < 12 {
+		return fmt.Errorf("The password_length must be at least 12")
+	}
+
+	if config.QuotaFileSize == 0 {
+		config.QuotaFileSize = 10
+	}
+
+	if config.QuotaFileSize < 0 {
+		return fmt.Errorf("Invalid quota_file_size: %d", config.QuotaFileSize)
+	}
+
+	if config.QuotaResetInterval == 0 {
+		config.QuotaResetInterval = 300
+	}
+
+	if config.QuotaResetInterval < 60 {
+		return fmt.Errorf("The quota_reset_interval must be at least 60 seconds")
+	}
+
+	if config.NetworkACL == "" {
+		config.NetworkACL = "lxd-demo"
+	}
+
+	err = environmentsValidate()
+	if err != nil {
+		return err
+	}
+
+	err = limitsValidate()
+	if err != nil {
+		return err
+	}
+
+	err = monitorValidate()
+	if err != nil {
+		return err
+	}
+
+	err = networkValidate()
+	if err != nil {
+		return err
+	}
+
+	if config.RetentionIPMode == "" {
+		config.RetentionIPMode = "prefix"
+	}
+
+	if !shared.StringInSlice(config.RetentionIPMode, []string{"prefix", "hash"}) {
+		return fmt.Errorf("Invalid retention_ip_mode: %s", config.RetentionIPMode)
+	}
+
+	if config.RetentionIPv4Mask == 0 {
+		config.RetentionIPv4Mask = 24
+	}
+
+	if config.RetentionIPv6Mask == 0 {
+		config.RetentionIPv6Mask = 48
+	}
+
+	if config.RetentionIPv4Mask < 0 || config.RetentionIPv4Mask > 32 {
+		return fmt.Errorf("Invalid retention_ipv4_mask: %d", config.RetentionIPv4Mask)
+	}
+
+	if config.RetentionIPv6Mask < 0 || config.RetentionIPv6Mask > 128 {
+		return fmt.Errorf("Invalid retention_ipv6_mask: %d", config.RetentionIPv6Mask)
+	}
+
+	if !shared.StringInSlice(config.ServerConsoleAudit, []string{"", "keystrokes", "commands"}) {
+		return fmt.Errorf("Invalid server_console_audit: %s", config.ServerConsoleAudit)
+	}
+
 	config.ServerTerms = strings.TrimRight(config.ServerTerms, "\n")
 	hash := sha256.New()
 	io.WriteString(hash, config.ServerTerms)
 	config.serverTermsHash = fmt.Sprintf("%x", hash.Sum(nil))
 
+	config.tutorials, err = tutorialsLoad()
+	if err != nil {
+		return err
+	}
+
 	if config.Container == "" && config.Image == "" {
 		return fmt.Errorf("No container or image specified in configuration")
 	}
@@ -141,6 +295,14 @@ func run() error {
 				err := parseConfig()
 				if err != nil {
 					fmt.Printf("Failed to parse configuration: %s\n", err)
+					continue
+				}
+
+				if lxdDaemon != nil {
+					err = networkSetup()
+					if err != nil {
+						fmt.Printf("Failed to setup the network ACL: %s\n", err)
+					}
 				}
 			case err := <-watcher.Error:
 				fmt.Printf("Inotify error: %s\n", err)
@@ -167,14 +329,29 @@ func run() error {
 		fmt.Printf("LXD is now available. Daemon starting.\n")
 	}
 
+	// Setup the network ACL
+	err = networkSetup()
+	if err != nil {
+		return fmt.Errorf("Failed to setup the network ACL: %s", err)
+	}
+
 	// Setup the database
 	err = dbSetup()
 	if err != nil {
 		return fmt.Errorf("Failed to setup the database: %s", err)
 	}
 
+	// Start the data retention job
+	go retentionRun()
+
+	// Start the resource usage monitor
+	go monitorRun()
+
+	// Start reclaiming idle sessions
+	go consoleIdleRun()
+
 	// Restore cleanup handler for existing containers
-	containers, err := dbActive()
+	containers, err := db.Active()
 	if err != nil {
 		return fmt.Errorf("Unable to read current containers: %s", err)
 	}
@@ -188,27 +365,61 @@ func run() error {
 		timeDuration, err := time.ParseDuration(fmt.Sprintf("%ds", duration))
 		if err != nil || duration <= 0 {
 			lxdForceDelete(lxdDaemon, containerName)
-			dbExpire(containerID)
+			db.Expire(containerID)
 			continue
 		}
 
 		time.AfterFunc(timeDuration, func() {
-			lxdForceDelete(lxdDaemon, containerName)
-			dbExpire(containerID)
+			containerExpire(containerID, containerName)
 		})
 	}
 
+	// Setup OpenID Connect
+	if config.OIDCIssuer != "" {
+		err = oidcSetup()
+		if err != nil {
+			return fmt.Errorf("Failed to setup OpenID Connect: %s", err)
+		}
+	}
+
+	// Setup the SSH gateway
+	if config.ServerSSHAddr != "" {
+		err = sshSetup()
+		if err != nil {
+			return err
+		}
+	}
+
 	// Setup the HTTP server
 	r := mux.NewRouter()
+	r.MatcherFunc(proxyHostMatcher).HandlerFunc(restProxyHandler)
 	r.Handle("/", http.RedirectHandler("/static", http.StatusMovedPermanently))
 	r.PathPrefix("/static").Handler(http.StripPrefix("/static", http.FileServer(http.Dir("static/"))))
 	r.HandleFunc("/1.0", restStatusHandler)
+	r.HandleFunc("/1.0/admin/audit", restAdminAuditHandler)
+	r.HandleFunc("/1.0/admin/reservations", restAdminReservationsHandler)
+	r.HandleFunc("/1.0/admin/tokens", restAdminTokensHandler)
+	r.HandleFunc("/1.0/admin/tokens/audit", restAdminTokensAuditHandler)
+	r.HandleFunc("/1.0/admin/tutorials", restAdminTutorialsHandler)
 	r.HandleFunc("/1.0/console", restConsoleHandler)
 	r.HandleFunc("/1.0/feedback", restFeedbackHandler)
+	r.HandleFunc("/1.0/file", restFileHandler)
 	r.HandleFunc("/1.0/info", restInfoHandler)
+	r.HandleFunc("/1.0/login", restLoginHandler)
+	r.HandleFunc("/1.0/login/callback", restLoginCallbackHandler)
+	r.HandleFunc("/1.0/logout", restLogoutHandler)
+	r.PathPrefix("/1.0/proxy/{token}/{port}").HandlerFunc(restProxyHandler)
+	r.HandleFunc("/1.0/reset", restResetHandler)
+	r.HandleFunc("/1.0/restore", restRestoreHandler)
+	r.HandleFunc("/1.0/snapshots", restSnapshotsHandler)
 	r.HandleFunc("/1.0/start", restStartHandler)
 	r.HandleFunc("/1.0/statistics", restStatisticsHandler)
 	r.HandleFunc("/1.0/terms", restTermsHandler)
+	r.HandleFunc("/1.0/tutorial", restTutorialHandler)
+	r.HandleFunc("/1.0/tutorials", restTutorialsHandler)
+	r.HandleFunc("/1.0/usage", restUsageHandler)
+	r.HandleFunc("/1.0/workshop", restWorkshopHandler)
+	r.HandleFunc("/1.0/workshops", restWorkshopsHandler)
 
 	err = http.ListenAndServe(config.ServerAddr, r)
 	if err != nil {
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// parseTestConfig runs parseConfig against the given lxd-demo.yaml content.
+func parseTestConfig(t *testing.T, content string) error {
+	dir, err := ioutil.TempDir("", "lxd-demo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "lxd-demo.yaml"), []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config = serverConfig{}
+	return parseConfig()
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		valid   bool
+	}{
+		{"minimal", "image: ubuntu/22.04\n", true},
+		{"no image", "server_addr: \":8080\"\n", false},
+		{"password length", "image: ubuntu/22.04\npassword_length: 12\n", true},
+		{"password length too short", "image: ubuntu/22.04\npassword_length: 8\n", false},
+		{"password length negative", "image: ubuntu/22.04\npassword_length: -1\n", false},
+		{"file size", "image: ubuntu/22.04\nquota_file_size: 100\n", true},
+		{"file size negative", "image: ubuntu/22.04\nquota_file_size: -1\n", false},
+		{"egress rule", "image: ubuntu/22.04\nnetwork_egress_rules:\n- destination: 10.0.0.0/8,192.0.2.1\n", true},
+		{"egress rule without destination", "image: ubuntu/22.04\nnetwork_egress_rules:\n- protocol: tcp\n  ports: \"80\"\n", true},
+		{"egress rule invalid destination", "image: ubuntu/22.04\nnetwork_egress_rules:\n- destination: 10.0.0.0/8,\n", false},
+		{"reset interval", "image: ubuntu/22.04\nquota_reset_interval: 60\n", true},
+		{"reset interval too short", "image: ubuntu/22.04\nquota_reset_interval: 10\n", false},
+		{"reset interval negative", "image: ubuntu/22.04\nquota_reset_interval: -300\n", false},
+		{"console user", "image: ubuntu/22.04\nconsole:\n  user: session\n", true},
+		{"console uid without user", "image: ubuntu/22.04\nconsole:\n  uid: 1000\n", false},
+		{"console session user when console only", "image: ubuntu/22.04\nserver_console_only: true\nconsole:\n  user: session\n", false},
+		{"environment console session user when console only", "image: ubuntu/22.04\nserver_console_only: true\nenvironments:\n  builder:\n    console:\n      user: session\n", false},
+		{"ipv4 mask", "image: ubuntu/22.04\nretention_ipv4_mask: 16\n", true},
+		{"ipv4 mask too large", "image: ubuntu/22.04\nretention_ipv4_mask: 33\n", false},
+		{"ipv4 mask negative", "image: ubuntu/22.04\nretention_ipv4_mask: -1\n", false},
+		{"ipv6 mask", "image: ubuntu/22.04\nretention_ipv6_mask: 128\n", true},
+		{"ipv6 mask too large", "image: ubuntu/22.04\nretention_ipv6_mask: 129\n", false},
+		{"ipv6 mask negative", "image: ubuntu/22.04\nretention_ipv6_mask: -8\n", false},
+	}
+
+	for _, test := range tests {
+		err := parseTestConfig(t, test.content)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: invalid configuration accepted", test.name)
+		}
+	}
+}
+
+func TestParseConfigExample(t *testing.T) {
+	content, err := ioutil.ReadFile("lxd-demo.yaml.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = parseTestConfig(t, string(content))
+	if err != nil {
+		t.Errorf("The example configuration is invalid: %s", err)
+	}
+
+	// The server would contact the provider when starting
+	if config.OIDCIssuer != "" {
+		t.Errorf("The example configuration requires an OpenID Connect provider: %s", config.OIDCIssuer)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lxc/lxd/shared"
+)
+
+type monitorRule struct {
+	Name      string  `yaml:"name"`
+	Metric    string  `yaml:"metric"`
+	Threshold float64 `yaml:"threshold"`
+	Duration  int     `yaml:"duration"`
+	Action    string  `yaml:"action"`
+}
+
+// monitorSession tracks the state of a container between two samples.
+type monitorSession struct {
+	cpuUsage   int64
+	cpuTime    time.Time
+	exceeding  map[string]time.Time
+	actionDone map[string]bool
+}
+
+func monitorValidate() error {
+	for _, rule := range config.MonitorRules {
+		if rule.Name == "" {
+			return fmt.Errorf("Monitoring rules must have a name")
+		}
+
+		if !shared.StringInSlice(rule.Metric, []string{"cpu", "memory", "processes", "network_in", "network_out"}) {
+			return fmt.Errorf("Invalid metric for monitoring rule %s: %s", rule.Name, rule.Metric)
+		}
+
+		if !shared.StringInSlice(rule.Action, []string{"warn", "throttle", "terminate", "ban"}) {
+			return fmt.Errorf("Invalid action for monitoring rule %s: %s", rule.Name, rule.Action)
+		}
+	}
+
+	return nil
+}
+
+// monitorRun periodically samples the resource usage of the active
+// containers and acts on the ones matching the monitoring rules.
+func monitorRun() {
+	sessions := map[int64]*monitorSession{}
+
+	for {
+		interval := config.MonitorInterval
+		if interval <= 0 {
+			interval = 30
+		}
+
+		time.Sleep(time.Duration(interval) * time.Second)
+
+		if len(config.MonitorRules) == 0 {
+			continue
+		}
+
+		containers, err := db.Active()
+		if err != nil {
+			fmt.Printf("Unable to read current containers: %s\n", err)
+			continue
+		}
+
+		active := map[int64]bool{}
+		for _, entry := range containers {
+			containerID := int64(entry[0].(int))
+			containerName := entry[1].(string)
+			active[containerID] = true
+
+			session, ok := sessions[containerID]
+			if !ok {
+				session = &monitorSession{exceeding: map[string]time.Time{}, actionDone: map[string]bool{}}
+				sessions[containerID] = session
+			}
+
+			monitorCheck(containerID, containerName, session)
+		}
+
+		// Forget about expired sessions
+		for containerID := range sessions {
+			if !active[containerID] {
+				delete(sessions, containerID)
+			}
+		}
+	}
+}
+
+func monitorCheck(containerID int64, containerName string, session *monitorSession) {
+	state, _, err := lxdDaemon.GetContainerState(containerName)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+
+	// Compute the current values
+	metrics := map[string]float64{}
+	if !session.cpuTime.IsZero() {
+		elapsed := now.Sub(session.cpuTime).Nanoseconds()
+		if elapsed > 0 {
+			metrics["cpu"] = float64(state.CPU.Usage-session.cpuUsage) * 100 / float64(elapsed)
+		}
+	}
+	session.cpuUsage = state.CPU.Usage
+	session.cpuTime = now
+
+	metrics["memory"] = float64(state.Memory.Usage) / 1024 / 1024
+	metrics["processes"] = float64(state.Processes)
+
+	for netName, net := range state.Network {
+		if netName == "lo" {
+			continue
+		}
+
+		metrics["network_in"] += float64(net.Counters.BytesReceived) / 1024 / 1024
+		metrics["network_out"] += float64(net.Counters.BytesSent) / 1024 / 1024
+	}
+
+	// Evaluate the rules
+	for _, rule := range config.MonitorRules {
+		value, ok := metrics[rule.Metric]
+		if !ok || value < rule.Threshold {
+			delete(session.exceeding, rule.Name)
+			continue
+		}
+
+		since, ok := session.exceeding[rule.Name]
+		if !ok {
+			since = now
+			session.exceeding[rule.Name] = since
+		}
+
+		if now.Sub(since) < time.Duration(rule.Duration)*time.Second {
+			continue
+		}
+
+		if session.actionDone[rule.Name] {
+			continue
+		}
+		session.actionDone[rule.Name] = true
+
+		reason := fmt.Sprintf("%s at %.0f (threshold %.0f) for %ds", rule.Metric, value, rule.Threshold, int(now.Sub(since).Seconds()))
+		err := monitorAction(containerID, containerName, rule, reason)
+		if err != nil {
+			fmt.Printf("Failed to apply monitoring rule %s to %s: %s\n", rule.Name, containerName, err)
+		}
+
+		if rule.Action == "terminate" || rule.Action == "ban" {
+			return
+		}
+	}
+}
+
+func monitorAction(containerID int64, containerName string, rule monitorRule, reason string) error {
+	fmt.Printf("Monitoring rule %s matched %s (%s), action: %s\n", rule.Name, containerName, reason, rule.Action)
+
+	err := db.RecordEvent(containerID, rule.Name, rule.Action, reason)
+	if err != nil {
+		return err
+	}
+
+	switch rule.Action {
+	case "throttle":
+		return monitorThrottle(containerName)
+	case "ban":
+		requestIP, requestUser, shared, err := db.GetRequester(containerID)
+		if err != nil {
+			return err
+		}
+
+		// Sessions started with a token, workshop or reservation code
+		// usually share their address with others (CI runners, classrooms)
+		// so only their account gets banned
+		if shared {
+			requestIP = ""
+		}
+
+		if requestIP != "" || requestUser != "" {
+			err = db.Ban(requestIP, requestUser, fmt.Sprintf("%s: %s", rule.Name, reason))
+			if err != nil {
+				return err
+			}
+		}
+
+		fallthrough
+	case "terminate":
+		lxdForceDelete(lxdDaemon, containerName)
+		proxyForget(containerName)
+		return db.Expire(containerID)
+	}
+
+	return nil
+}
+
+// monitorThrottle restricts the container to a tenth of a CPU and 1Mbit/s
+// of network traffic.
+func monitorThrottle(containerName string) error {
+	ct, etag, err := lxdDaemon.GetContainer(containerName)
+	if err != nil {
+		return err
+	}
+
+	ct.Config["limits.cpu.allowance"] = "10%"
+
+	for deviceName, device := range ct.ExpandedDevices {
+		if device["type"] != "nic" {
+			continue
+		}
+
+		nic := map[string]string{}
+		for k, v := range device {
+			nic[k] = v
+		}
+
+		nic["limits.ingress"] = "1Mbit"
+		nic["limits.egress"] = "1Mbit"
+		ct.Devices[deviceName] = nic
+	}
+
+	op, err := lxdDaemon.UpdateContainer(containerName, ct.Writable(), etag)
+	if err != nil {
+		return err
+	}
+
+	return op.Wait()
+}
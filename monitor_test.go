@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMonitorAction(t *testing.T) {
+	defer dbTestGlobal(t)()
+
+	daemon := &lxdTestServer{}
+	lxdDaemon = daemon
+	defer func() { lxdDaemon = nil }()
+
+	config = serverConfig{}
+
+	tests := []struct {
+		name     string
+		ip       string
+		workshop int64
+		action   string
+		banned   bool
+	}{
+		{"terminate", "10.1.1.1", 0, "terminate", false},
+		{"ban", "10.1.1.2", 0, "ban", true},
+		{"ban workshop session", "10.1.1.3", 1, "ban", false},
+	}
+
+	for i, test := range tests {
+		now := time.Now().Unix()
+		containerName := "tryit-" + test.name
+		id, err := db.New(test.name, "", containerName, "10.0.0.1", "user", now+3600, now, test.ip, "", 0, test.workshop, 0, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Pretend the proxy was used
+		proxyLock.Lock()
+		proxyAddresses[containerName] = proxyAddress{ip: "10.0.0.1", expiry: time.Now().Add(time.Hour)}
+		proxyLock.Unlock()
+
+		err = monitorAction(id, containerName, monitorRule{Name: "rule", Action: test.action}, "reason")
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		if len(daemon.deleted) != i+1 || daemon.deleted[i] != containerName {
+			t.Errorf("%s: deleted %v", test.name, daemon.deleted)
+		}
+
+		proxyLock.Lock()
+		_, cached := proxyAddresses[containerName]
+		proxyLock.Unlock()
+		if cached {
+			t.Errorf("%s: proxy address still cached", test.name)
+		}
+
+		sessionId, _, _, _, _, err := db.GetContainer(test.name, true)
+		if err != nil || sessionId != -1 {
+			t.Errorf("%s: session still active: %d, %v", test.name, sessionId, err)
+		}
+
+		banned, err := db.IsBanned(test.ip, "")
+		if err != nil || banned != test.banned {
+			t.Errorf("%s: IsBanned = %v, %v", test.name, banned, err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/api"
+)
+
+type networkRule struct {
+	Destination string `yaml:"destination"`
+	Protocol    string `yaml:"protocol"`
+	Ports       string `yaml:"ports"`
+}
+
+func networkValidate() error {
+	if !shared.StringInSlice(config.NetworkEgress, []string{"", "allow", "deny", "none"}) {
+		return fmt.Errorf("Invalid network_egress: %s", config.NetworkEgress)
+	}
+
+	for _, rule := range config.NetworkEgressRules {
+		// No destination matches any destination
+		if rule.Destination != "" {
+			for _, destination := range strings.Split(rule.Destination, ",") {
+				_, _, err := net.ParseCIDR(destination)
+				if err != nil && net.ParseIP(destination) == nil {
+					return fmt.Errorf("Invalid network rule destination: %s", destination)
+				}
+			}
+		}
+
+		if !shared.StringInSlice(rule.Protocol, []string{"", "tcp", "udp", "icmp4", "icmp6"}) {
+			return fmt.Errorf("Invalid network rule protocol: %s", rule.Protocol)
+		}
+
+		if rule.Ports != "" && !shared.StringInSlice(rule.Protocol, []string{"tcp", "udp"}) {
+			return fmt.Errorf("Network rule ports require the tcp or udp protocol")
+		}
+	}
+
+	return nil
+}
+
+// networkSetup creates or updates the network ACL applied to the containers
+// to match the egress policy.
+func networkSetup() error {
+	if config.NetworkEgress == "" {
+		return nil
+	}
+
+	action := "allow"
+	if config.NetworkEgress == "deny" {
+		action = "reject"
+	}
+
+	acl := api.NetworkACLPut{
+		Description: "Managed by lxd-demo-server",
+		Egress:      []api.NetworkACLRule{},
+		Ingress:     []api.NetworkACLRule{},
+	}
+
+	if config.NetworkEgress != "none" {
+		for _, rule := range config.NetworkEgressRules {
+			acl.Egress = append(acl.Egress, api.NetworkACLRule{
+				Action:          action,
+				Destination:     rule.Destination,
+				Protocol:        rule.Protocol,
+				DestinationPort: rule.Ports,
+				State:           "enabled",
+			})
+		}
+	}
+
+	_, etag, err := lxdDaemon.GetNetworkACL(config.NetworkACL)
+	if err != nil {
+		req := api.NetworkACLsPost{}
+		req.Name = config.NetworkACL
+		req.NetworkACLPut = acl
+
+		return lxdDaemon.CreateNetworkACL(req)
+	}
+
+	return lxdDaemon.UpdateNetworkACL(config.NetworkACL, acl, etag)
+}
+
+// networkConfigureDevices applies the bandwidth limits and egress policy to
+// the container's network interface.
+func networkConfigureDevices(ct *api.Container) {
+	if config.NetworkEgress == "" && config.QuotaNetworkIngress == 0 && config.QuotaNetworkEgress == 0 {
+		return
+	}
+
+	name := "eth0"
+	_, ok := ct.ExpandedDevices[name]
+	if !ok {
+		name = ""
+		for deviceName, device := range ct.ExpandedDevices {
+			if device["type"] == "nic" {
+				name = deviceName
+				break
+			}
+		}
+	}
+
+	if name == "" {
+		return
+	}
+
+	nic := map[string]string{}
+	for k, v := range ct.ExpandedDevices[name] {
+		nic[k] = v
+	}
+
+	if config.QuotaNetworkIngress > 0 {
+		nic["limits.ingress"] = fmt.Sprintf("%dMbit", config.QuotaNetworkIngress)
+	}
+
+	if config.QuotaNetworkEgress > 0 {
+		nic["limits.egress"] = fmt.Sprintf("%dMbit", config.QuotaNetworkEgress)
+	}
+
+	if config.NetworkEgress != "" {
+		nic["security.acls"] = config.NetworkACL
+		nic["security.acls.default.ingress.action"] = "allow"
+		if config.NetworkEgress == "deny" {
+			nic["security.acls.default.egress.action"] = "allow"
+		} else {
+			nic["security.acls.default.egress.action"] = "reject"
+		}
+	}
+
+	ct.Devices[name] = nic
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+)
+
+// Global variables
+var oidcVerifier *oidc.IDTokenVerifier
+var oidcConfig oauth2.Config
+
+// How long a login remains valid
+const oidcLoginTime = 24 * time.Hour
+
+// The login cookie is only sent where it's needed, keeping it away from
+// proxied content in particular
+var oidcCookiePaths = []string{"/1.0/start", "/1.0/logout"}
+
+// oidcSetup discovers the OpenID Connect provider, logins are then required
+// to start sessions.
+func oidcSetup() error {
+	provider, err := oidc.NewProvider(context.Background(), config.OIDCIssuer)
+	if err != nil {
+		return err
+	}
+
+	oidcVerifier = provider.Verifier(&oidc.Config{ClientID: config.OIDCClientID})
+	oidcConfig = oauth2.Config{
+		ClientID:     config.OIDCClientID,
+		ClientSecret: config.OIDCClientSecret,
+		RedirectURL:  config.OIDCRedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID},
+	}
+
+	return nil
+}
+
+func oidcHashToken(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+// oidcSetCookie sets the login cookie, clearing it if token is empty.
+func oidcSetCookie(w http.ResponseWriter, r *http.Request, token string, expiry time.Time) {
+	for _, path := range oidcCookiePaths {
+		cookie := &http.Cookie{
+			Name:     "tryit_login",
+			Value:    token,
+			Path:     path,
+			Expires:  expiry,
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		}
+
+		if token == "" {
+			cookie.Expires = time.Time{}
+			cookie.MaxAge = -1
+		}
+
+		http.SetCookie(w, cookie)
+	}
+}
+
+// oidcUser returns the subject of the logged in user, or an empty string
+// if the request doesn't come with a valid login.
+func oidcUser(r *http.Request) (string, error) {
+	if oidcVerifier == nil {
+		return "", nil
+	}
+
+	cookie, err := r.Cookie("tryit_login")
+	if err != nil {
+		return "", nil
+	}
+
+	return db.GetLogin(oidcHashToken(cookie.Value))
+}
+
+func restLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	if oidcVerifier == nil {
+		http.Error(w, "Login is disabled", 400)
+		return
+	}
+
+	state, err := randomHex(16)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "tryit_oidc_state",
+		Value:    state,
+		Path:     "/1.0/login",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, oidcConfig.AuthCodeURL(state), http.StatusFound)
+}
+
+func restLoginCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	if oidcVerifier == nil {
+		http.Error(w, "Login is disabled", 400)
+		return
+	}
+
+	// Validate the state
+	state, err := r.Cookie("tryit_oidc_state")
+	if err != nil || state.Value == "" || state.Value != r.FormValue("state") {
+		http.Error(w, "Invalid login state", 400)
+		return
+	}
+
+	// Get and validate the ID token
+	oauth2Token, err := oidcConfig.Exchange(r.Context(), r.FormValue("code"))
+	if err != nil {
+		http.Error(w, "Unable to complete the login", 401)
+		return
+	}
+
+	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
+	if !ok {
+		http.Error(w, "Missing ID token", 401)
+		return
+	}
+
+	idToken, err := oidcVerifier.Verify(r.Context(), rawIDToken)
+	if err != nil {
+		http.Error(w, "Invalid ID token", 401)
+		return
+	}
+
+	// Record the login
+	token, err := randomHex(32)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	expiry := time.Now().Add(oidcLoginTime)
+	err = db.NewLogin(oidcHashToken(token), idToken.Subject, expiry.Unix())
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	oidcSetCookie(w, r, token, expiry)
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func restLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	cookie, err := r.Cookie("tryit_login")
+	if err == nil {
+		err = db.DeleteLogin(oidcHashToken(cookie.Value))
+		if err != nil {
+			http.Error(w, "Internal server error", 500)
+			return
+		}
+	}
+
+	oidcSetCookie(w, r, "", time.Time{})
+
+	// Older versions set the cookie for the whole server
+	http.SetCookie(w, &http.Cookie{
+		Name:   "tryit_login",
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// oidcTestIssuer is a minimal OpenID Connect provider, issuing ID tokens for
+// "some-subject" in exchange for the "valid" authorization code.
+func oidcTestIssuer(t *testing.T) *httptest.Server {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithHeader("kid", "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var issuer *httptest.Server
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                issuer.URL,
+			"authorization_endpoint":                issuer.URL + "/auth",
+			"token_endpoint":                        issuer.URL + "/token",
+			"jwks_uri":                              issuer.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+			Key:       &key.PublicKey,
+			KeyID:     "test",
+			Algorithm: "RS256",
+			Use:       "sig",
+		}}})
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "valid" {
+			http.Error(w, `{"error": "invalid_grant"}`, 400)
+			return
+		}
+
+		claims, _ := json.Marshal(map[string]interface{}{
+			"iss": issuer.URL,
+			"sub": "some-subject",
+			"aud": "lxd-demo",
+			"iat": time.Now().Unix(),
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+
+		signed, err := signer.Sign(claims)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		idToken, err := signed.CompactSerialize()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+
+	issuer = httptest.NewServer(mux)
+	return issuer
+}
+
+// oidcTestCookie returns the named cookie set by the response.
+func oidcTestCookie(rec *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+
+	return nil
+}
+
+func TestOIDCLogin(t *testing.T) {
+	defer dbTestGlobal(t)()
+
+	issuer := oidcTestIssuer(t)
+	defer issuer.Close()
+
+	config = serverConfig{
+		OIDCClientID:     "lxd-demo",
+		OIDCClientSecret: "secret",
+		OIDCIssuer:       issuer.URL,
+		OIDCRedirectURL:  "http://demo.example.net/1.0/login/callback",
+	}
+
+	err := oidcSetup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { oidcVerifier = nil }()
+
+	// Start the login
+	rec := httptest.NewRecorder()
+	restLoginHandler(rec, httptest.NewRequest("GET", "/1.0/login", nil))
+
+	if rec.Code != http.StatusFound {
+		t.Fatalf("/1.0/login returned %d", rec.Code)
+	}
+
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil || location.Path != "/auth" {
+		t.Fatalf("/1.0/login redirected to %q", rec.Header().Get("Location"))
+	}
+
+	state := oidcTestCookie(rec, "tryit_oidc_state")
+	if state == nil || state.Value != location.Query().Get("state") {
+		t.Fatalf("/1.0/login state cookie doesn't match the redirect: %v", state)
+	}
+
+	// Come back from the provider
+	tests := []struct {
+		name   string
+		state  string
+		code   string
+		status int
+	}{
+		{"wrong state", "forged", "valid", 400},
+		{"wrong code", state.Value, "invalid", 401},
+		{"valid", state.Value, "valid", http.StatusFound},
+	}
+
+	var login *http.Cookie
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/1.0/login/callback?state="+test.state+"&code="+test.code, nil)
+		req.AddCookie(state)
+
+		rec = httptest.NewRecorder()
+		restLoginCallbackHandler(rec, req)
+
+		if rec.Code != test.status {
+			t.Fatalf("%s: /1.0/login/callback returned %d, want %d: %s", test.name, rec.Code, test.status, rec.Body.String())
+		}
+
+		login = oidcTestCookie(rec, "tryit_login")
+	}
+
+	if login == nil || login.Value == "" {
+		t.Fatal("/1.0/login/callback didn't set the login cookie")
+	}
+
+	// The login cookie is only meant for the endpoints needing it
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == "tryit_login" && cookie.Path != "/1.0/start" && cookie.Path != "/1.0/logout" {
+			t.Errorf("Login cookie set for %q", cookie.Path)
+		}
+	}
+
+	// Use the login
+	req := httptest.NewRequest("POST", "/1.0/start", nil)
+	req.AddCookie(login)
+
+	user, err := oidcUser(req)
+	if err != nil || user != "some-subject" {
+		t.Fatalf("oidcUser = %q, %v", user, err)
+	}
+
+	req = httptest.NewRequest("POST", "/1.0/start", nil)
+	req.AddCookie(&http.Cookie{Name: "tryit_login", Value: "forged"})
+
+	user, err = oidcUser(req)
+	if err != nil || user != "" {
+		t.Errorf("oidcUser with a forged cookie = %q, %v", user, err)
+	}
+
+	// Log out
+	req = httptest.NewRequest("POST", "/1.0/logout", nil)
+	req.AddCookie(login)
+	restLogoutHandler(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest("POST", "/1.0/start", nil)
+	req.AddCookie(login)
+
+	user, err = oidcUser(req)
+	if err != nil || user != "" {
+		t.Errorf("oidcUser after logging out = %q, %v", user, err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/lxc/lxd/client"
+)
+
+// How long a provisioning command can run when it doesn't set a timeout, as
+// the user is waiting on it
+const provisionTimeout = 300
+
+type provisionFile struct {
+	Path    string `yaml:"path"`
+	Content string `yaml:"content"`
+	Source  string `yaml:"source"`
+	Mode    int    `yaml:"mode"`
+	UID     int64  `yaml:"uid"`
+	GID     int64  `yaml:"gid"`
+}
+
+type provisionCommand struct {
+	Command []string `yaml:"command"`
+	Timeout int      `yaml:"timeout"`
+}
+
+type provisionConfig struct {
+	Commands    []provisionCommand `yaml:"commands"`
+	Environment map[string]string  `yaml:"environment"`
+	Files       []provisionFile    `yaml:"files"`
+}
+
+func provisionValidate(provision provisionConfig) error {
+	for _, file := range provision.Files {
+		if file.Path == "" || file.Path[0] != '/' {
+			return fmt.Errorf("Invalid provisioning file path: %s", file.Path)
+		}
+
+		if file.Content != "" && file.Source != "" {
+			return fmt.Errorf("Provisioning file %s can't have both content and source", file.Path)
+		}
+
+		if file.Source != "" {
+			_, err := os.Stat(file.Source)
+			if err != nil {
+				return fmt.Errorf("Invalid source for provisioning file %s: %s", file.Path, err)
+			}
+		}
+	}
+
+	for _, command := range provision.Commands {
+		if len(command.Command) == 0 {
+			return fmt.Errorf("Empty provisioning command")
+		}
+
+		if command.Timeout < 0 {
+			return fmt.Errorf("Invalid timeout for provisioning command: %v", command.Command)
+		}
+	}
+
+	return nil
+}
+
+// containerProvision pushes the environment's files to the container and
+// then runs its commands in order, failing on the first non-zero exit code.
+func containerProvision(env environment, containerName string) error {
+	if env.Provision == nil {
+		return nil
+	}
+
+	for _, file := range env.Provision.Files {
+		content := []byte(file.Content)
+		if file.Source != "" {
+			data, err := ioutil.ReadFile(file.Source)
+			if err != nil {
+				return err
+			}
+
+			content = data
+		}
+
+		mode := file.Mode
+		if mode == 0 {
+			mode = 0644
+		}
+
+		args := lxd.ContainerFileArgs{
+			Content:   bytes.NewReader(content),
+			UID:       file.UID,
+			GID:       file.GID,
+			Mode:      mode,
+			Type:      "file",
+			WriteMode: "overwrite",
+		}
+
+		err := lxdDaemon.CreateContainerFile(containerName, file.Path, args)
+		if err != nil {
+			return fmt.Errorf("Failed to push %s: %s", file.Path, err)
+		}
+	}
+
+	for _, command := range env.Provision.Commands {
+		timeout := command.Timeout
+		if timeout == 0 {
+			timeout = provisionTimeout
+		}
+
+		status, output, err := lxdExec(lxdDaemon, containerName, command.Command, env.Provision.Environment, time.Duration(timeout)*time.Second)
+		if err != nil {
+			return fmt.Errorf("Failed to run %v: %s", command.Command, err)
+		}
+
+		if status != 0 {
+			return fmt.Errorf("Command %v failed with exit code %d: %s", command.Command, status, output)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// proxyLimiter paces the traffic of a session to the configured bandwidth.
+type proxyLimiter struct {
+	lock     sync.Mutex
+	next     time.Time
+	lastUsed time.Time
+}
+
+func (l *proxyLimiter) Wait(n int) {
+	rate := int64(config.ServerProxyBandwidth) * 1024
+	if rate <= 0 {
+		return
+	}
+
+	l.lock.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / rate))
+	l.lastUsed = now
+	l.lock.Unlock()
+
+	time.Sleep(delay)
+}
+
+type proxyAddress struct {
+	ip     string
+	expiry time.Time
+}
+
+var proxyLock sync.Mutex
+var proxyLimiters = map[int64]*proxyLimiter{}
+var proxyAddresses = map[string]proxyAddress{}
+
+func proxyGetLimiter(sessionId int64) *proxyLimiter {
+	proxyLock.Lock()
+	defer proxyLock.Unlock()
+
+	limiter, ok := proxyLimiters[sessionId]
+	if ok {
+		return limiter
+	}
+
+	// Forget about idle sessions
+	for id, entry := range proxyLimiters {
+		entry.lock.Lock()
+		idle := time.Since(entry.lastUsed) > time.Hour
+		entry.lock.Unlock()
+
+		if idle {
+			delete(proxyLimiters, id)
+		}
+	}
+
+	limiter = &proxyLimiter{lastUsed: time.Now()}
+	proxyLimiters[sessionId] = limiter
+
+	return limiter
+}
+
+// proxyGetAddress returns the address the container was given when created,
+// as long as it still holds it. Users are root in their container and so may
+// configure any other address, which mustn't be reachable through the proxy.
+// The check is cached for a little while to avoid querying LXD on every
+// request.
+func proxyGetAddress(containerName string, containerIP string) (string, error) {
+	if containerIP == "" {
+		return "", fmt.Errorf("Container has no recorded address")
+	}
+
+	proxyLock.Lock()
+	entry, ok := proxyAddresses[containerName]
+	proxyLock.Unlock()
+
+	if ok && entry.ip == containerIP && time.Now().Before(entry.expiry) {
+		return entry.ip, nil
+	}
+
+	valid, err := lxdContainerHasIP(lxdDaemon, containerName, containerIP)
+	if err != nil {
+		return "", err
+	}
+
+	if !valid {
+		return "", fmt.Errorf("Container no longer holds address %s", containerIP)
+	}
+
+	proxyLock.Lock()
+	proxyAddresses[containerName] = proxyAddress{ip: containerIP, expiry: time.Now().Add(30 * time.Second)}
+	proxyLock.Unlock()
+
+	return containerIP, nil
+}
+
+// proxyForget drops the cached address of a container being replaced.
+func proxyForget(containerName string) {
+	proxyLock.Lock()
+	delete(proxyAddresses, containerName)
+	proxyLock.Unlock()
+}
+
+// proxyHostTarget extracts the proxy token and port from a
+// "<token>-<port>.<server_proxy_domain>" host, "<token>.<server_proxy_domain>"
+// standing for the first allowed port. The port is -1 when invalid.
+func proxyHostTarget(host string) (string, int) {
+	if config.ServerProxyDomain == "" {
+		return "", 0
+	}
+
+	hostname, _, err := net.SplitHostPort(host)
+	if err == nil {
+		host = hostname
+	}
+
+	suffix := "." + config.ServerProxyDomain
+	if !strings.HasSuffix(host, suffix) {
+		return "", 0
+	}
+
+	token := strings.TrimSuffix(host, suffix)
+	fields := strings.SplitN(token, "-", 2)
+	if len(fields) == 1 {
+		if len(config.ServerProxyPorts) == 0 {
+			return token, 0
+		}
+
+		return token, config.ServerProxyPorts[0]
+	}
+
+	port, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return fields[0], -1
+	}
+
+	return fields[0], port
+}
+
+func proxyHostMatcher(r *http.Request, rm *mux.RouteMatch) bool {
+	token, _ := proxyHostTarget(r.Host)
+	return token != ""
+}
+
+// proxyConn throttles the traffic of hijacked (websocket) connections.
+type proxyConn struct {
+	net.Conn
+	limiter *proxyLimiter
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.limiter.Wait(n)
+	return n, err
+}
+
+func (c *proxyConn) Write(b []byte) (int, error) {
+	c.limiter.Wait(len(b))
+	return c.Conn.Write(b)
+}
+
+// proxyResponseWriter throttles the responses sent to the client.
+type proxyResponseWriter struct {
+	http.ResponseWriter
+	limiter *proxyLimiter
+}
+
+func (w *proxyResponseWriter) Write(b []byte) (int, error) {
+	w.limiter.Wait(len(b))
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *proxyResponseWriter) Flush() {
+	flusher, ok := w.ResponseWriter.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+}
+
+func (w *proxyResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("Connection doesn't support hijacking")
+	}
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &proxyConn{Conn: conn, limiter: w.limiter}, brw, nil
+}
+
+// proxyBody throttles the request bodies sent by the client.
+type proxyBody struct {
+	io.ReadCloser
+	limiter *proxyLimiter
+}
+
+func (b *proxyBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.limiter.Wait(n)
+	return n, err
+}
+
+func restProxyHandler(w http.ResponseWriter, r *http.Request) {
+	if len(config.ServerProxyPorts) == 0 {
+		http.Error(w, "Proxying is disabled", 400)
+		return
+	}
+
+	// Get the session and port
+	var token string
+	var port int
+	var path string
+	var sandbox bool
+
+	vars := mux.Vars(r)
+	if vars["token"] != "" {
+		var err error
+
+		// Content served from this server's origin could otherwise act on
+		// its behalf, so only allow it when there's no dedicated domain and
+		// then sandbox it
+		if config.ServerProxyDomain != "" {
+			http.Error(w, "Proxying is only available through the proxy domain", 404)
+			return
+		}
+		sandbox = true
+
+		token = vars["token"]
+		port, err = strconv.Atoi(vars["port"])
+		if err != nil {
+			http.Error(w, "Invalid port", 400)
+			return
+		}
+
+		path = strings.TrimPrefix(r.URL.Path, fmt.Sprintf("/1.0/proxy/%s/%s", vars["token"], vars["port"]))
+	} else {
+		token, port = proxyHostTarget(r.Host)
+		if port == -1 {
+			http.Error(w, "Invalid port", 400)
+			return
+		}
+
+		path = r.URL.Path
+	}
+
+	allowed := false
+	for _, entry := range config.ServerProxyPorts {
+		if entry == port {
+			allowed = true
+			break
+		}
+	}
+
+	if !allowed {
+		http.Error(w, "Port not allowed", 403)
+		return
+	}
+
+	// Get the container
+	sessionId, containerName, containerIP, err := db.GetProxySession(token)
+	if err != nil || sessionId == -1 {
+		http.Error(w, "Session not found", 404)
+		return
+	}
+
+	containerIP, err = proxyGetAddress(containerName, containerIP)
+	if err != nil {
+		fmt.Printf("Unable to proxy to %s: %s\n", containerName, err)
+		http.Error(w, "Container unreachable", 502)
+		return
+	}
+
+	// Proxy the request
+	limiter := proxyGetLimiter(sessionId)
+	target := net.JoinHostPort(containerIP, fmt.Sprintf("%d", port))
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = target
+			req.URL.Path = path
+			req.URL.RawPath = ""
+
+			if req.URL.Path == "" {
+				req.URL.Path = "/"
+			}
+
+			// Don't leak the client's credentials to the container
+			req.Header.Del("Authorization")
+			req.Header.Del("Cookie")
+			req.Header.Del("Proxy-Authorization")
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			if sandbox {
+				resp.Header.Del("Set-Cookie")
+				resp.Header.Set("Content-Security-Policy", "sandbox allow-forms allow-modals allow-popups allow-scripts")
+			}
+
+			return nil
+		},
+	}
+
+	if r.Body != nil {
+		r.Body = &proxyBody{ReadCloser: r.Body, limiter: limiter}
+	}
+
+	proxy.ServeHTTP(&proxyResponseWriter{ResponseWriter: w, limiter: limiter}, r)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestProxy(t *testing.T) {
+	defer dbTestGlobal(t)()
+
+	// Stand in for a service running in the container
+	var received http.Header
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		http.SetCookie(w, &http.Cookie{Name: "tryit_login", Value: "forged", Path: "/"})
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer service.Close()
+
+	host, portStr, err := net.SplitHostPort(service.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	_, err = db.New("session-id", "proxytoken", "tryit-proxy", host, "user", now+3600, now, "10.1.1.1", "", 0, 0, 0, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The container may claim other addresses, only its own gets proxied to
+	daemon := &lxdTestServer{addresses: map[string][]string{"tryit-proxy": {host}}}
+	lxdDaemon = daemon
+	defer func() { lxdDaemon = nil }()
+	defer proxyForget("tryit-proxy")
+
+	r := mux.NewRouter()
+	r.MatcherFunc(proxyHostMatcher).HandlerFunc(restProxyHandler)
+	r.PathPrefix("/1.0/proxy/{token}/{port}").HandlerFunc(restProxyHandler)
+
+	tests := []struct {
+		name    string
+		domain  string
+		host    string
+		path    string
+		address string
+		status  int
+		sandbox bool
+	}{
+		{"path", "", "demo.example.net", "/1.0/proxy/proxytoken/" + portStr + "/index.html", host, 200, true},
+		{"path with session id", "", "demo.example.net", "/1.0/proxy/session-id/" + portStr + "/index.html", host, 404, false},
+		{"path with a proxy domain", "proxy.example.net", "demo.example.net", "/1.0/proxy/proxytoken/" + portStr + "/index.html", host, 404, false},
+		{"path with a port not allowed", "", "demo.example.net", "/1.0/proxy/proxytoken/22/index.html", host, 403, false},
+		{"path with a changed address", "", "demo.example.net", "/1.0/proxy/proxytoken/" + portStr + "/index.html", "192.0.2.1", 502, false},
+		{"domain", "proxy.example.net", "proxytoken.proxy.example.net", "/index.html", host, 200, false},
+		{"domain with port", "proxy.example.net", "proxytoken-" + portStr + ".proxy.example.net", "/index.html", host, 200, false},
+		{"domain with a port not allowed", "proxy.example.net", "proxytoken-22.proxy.example.net", "/index.html", host, 403, false},
+		{"domain with an invalid port", "proxy.example.net", "proxytoken-http.proxy.example.net", "/index.html", host, 400, false},
+		{"domain with a changed address", "proxy.example.net", "proxytoken.proxy.example.net", "/index.html", "192.0.2.1", 502, false},
+		{"domain with session id", "proxy.example.net", "session-id.proxy.example.net", "/index.html", host, 400, false},
+	}
+
+	for _, test := range tests {
+		config = serverConfig{ServerProxyDomain: test.domain, ServerProxyPorts: []int{port, 8080}}
+		received = nil
+
+		daemon.lock.Lock()
+		daemon.addresses["tryit-proxy"] = []string{test.address}
+		daemon.lock.Unlock()
+		proxyForget("tryit-proxy")
+
+		req := httptest.NewRequest("GET", test.path, nil)
+		req.Host = test.host
+		req.Header.Set("Authorization", "Bearer secret")
+		req.AddCookie(&http.Cookie{Name: "tryit_login", Value: "secret"})
+
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+
+		if rec.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, rec.Code, test.status)
+			continue
+		}
+
+		if test.status != 200 {
+			continue
+		}
+
+		if rec.Body.String() != "/index.html" {
+			t.Errorf("%s: proxied to %q", test.name, rec.Body.String())
+		}
+
+		if received.Get("Authorization") != "" || received.Get("Cookie") != "" {
+			t.Errorf("%s: credentials passed on to the container: %v", test.name, received)
+		}
+
+		csp := rec.Header().Get("Content-Security-Policy")
+		if test.sandbox && (csp == "" || rec.Header().Get("Set-Cookie") != "") {
+			t.Errorf("%s: response wasn't sandboxed: %v", test.name, rec.Header())
+		} else if !test.sandbox && csp != "" {
+			t.Errorf("%s: unexpected sandbox: %v", test.name, rec.Header())
+		}
+	}
+}
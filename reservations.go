@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type reservationPost struct {
+	Name  string `json:"name"`
+	Slots int    `json:"slots"`
+	Start int64  `json:"start"`
+	End   int64  `json:"end"`
+}
+
+// reservationCheck validates a reservation code, returning its id and
+// number of slots, the id being 0 if it isn't active now.
+func reservationCheck(code string) (int64, int, error) {
+	id, slots, start, end, err := db.GetReservation(strings.ToUpper(code))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	now := time.Now().Unix()
+	if id == 0 || now < start || now >= end {
+		return 0, 0, nil
+	}
+
+	return id, slots, nil
+}
+
+// reservationCapacity checks that "slots" more sessions can be reserved for
+// the time window.
+func reservationCapacity(start int64, end int64, slots int) (bool, error) {
+	capacity, err := db.ReservedCapacity(start, end)
+	if err != nil {
+		return false, err
+	}
+
+	return capacity+slots <= config.ServerContainersMax, nil
+}
+
+func restAdminReservationsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !restAdminAuth(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		restAdminReservationsGet(w, r)
+	case "POST":
+		restAdminReservationsPost(w, r)
+	case "DELETE":
+		restAdminReservationsDelete(w, r)
+	default:
+		http.Error(w, "Not implemented", 501)
+	}
+}
+
+func restAdminReservationsGet(w http.ResponseWriter, r *http.Request) {
+	reservations, err := db.GetReservations()
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	body := []map[string]interface{}{}
+	for _, entry := range reservations {
+		body = append(body, map[string]interface{}{
+			"code":   entry[0],
+			"name":   entry[1],
+			"slots":  entry[2],
+			"start":  entry[3],
+			"end":    entry[4],
+			"active": entry[5],
+		})
+	}
+
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
+
+func restAdminReservationsPost(w http.ResponseWriter, r *http.Request) {
+	req := reservationPost{}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request", 400)
+		return
+	}
+
+	if req.Slots <= 0 || req.Start <= 0 || req.End <= req.Start || req.End <= time.Now().Unix() {
+		http.Error(w, "Invalid reservation slots or time window", 400)
+		return
+	}
+
+	// Check that the slots can be reserved
+	available, err := reservationCapacity(req.Start, req.End, req.Slots)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	if !available {
+		http.Error(w, "Not enough capacity for this time window", 409)
+		return
+	}
+
+	code, err := credentialsUnusedCode(func(code string) (int64, error) {
+		id, _, _, _, err := db.GetReservation(code)
+		return id, err
+	})
+	if err != nil {
+		fmt.Printf("Unable to generate a reservation code: %s\n", err)
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	err = db.NewReservation(code, req.Name, req.Slots, req.Start, req.End)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	body := make(map[string]interface{})
+	body["code"] = code
+
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
+
+func restAdminReservationsDelete(w http.ResponseWriter, r *http.Request) {
+	code := r.FormValue("code")
+	if code == "" {
+		http.Error(w, "Missing reservation code", 400)
+		return
+	}
+
+	deleted, err := db.DeleteReservation(strings.ToUpper(code))
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	if !deleted {
+		http.Error(w, fmt.Sprintf("Reservation not found: %s", code), 404)
+		return
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminReservationsPost(t *testing.T) {
+	defer dbTestGlobal(t)()
+
+	config = serverConfig{ServerAdminKeys: []string{"admin"}, ServerContainersMax: 10}
+
+	start := time.Now().Unix()
+	end := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"valid", fmt.Sprintf(`{"name": "talk", "slots": 6, "start": %d, "end": %d}`, start, end), 200},
+		{"over capacity", fmt.Sprintf(`{"name": "webinar", "slots": 5, "start": %d, "end": %d}`, start, end), 409},
+		{"no slots", fmt.Sprintf(`{"name": "webinar", "start": %d, "end": %d}`, start, end), 400},
+		{"past window", fmt.Sprintf(`{"name": "webinar", "slots": 1, "start": %d, "end": %d}`, start-7200, start-3600), 400},
+	}
+
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		restAdminReservationsHandler(rec, httptest.NewRequest("POST", "/1.0/admin/reservations?key=admin", strings.NewReader(test.body)))
+
+		if rec.Code != test.status {
+			t.Errorf("%s: got status %d, want %d: %s", test.name, rec.Code, test.status, rec.Body.String())
+		}
+	}
+
+	// Database errors aren't passed on to the client
+	_, err := db.(*dbSqlite).conn.Exec("ALTER TABLE reservations RENAME COLUMN code TO broken;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	restAdminReservationsHandler(rec, httptest.NewRequest("POST", "/1.0/admin/reservations?key=admin", strings.NewReader(fmt.Sprintf(`{"name": "webinar", "slots": 1, "start": %d, "end": %d}`, start, end))))
+
+	if rec.Code != 500 || strings.TrimSpace(rec.Body.String()) != "Internal server error" {
+		t.Errorf("Failing code lookup: got status %d: %s", rec.Code, rec.Body.String())
+	}
+}
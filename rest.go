@@ -6,16 +6,17 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/dustinkirkland/golang-petname"
 	"github.com/gorilla/websocket"
 	"github.com/lxc/lxd/client"
-	lxdconfig "github.com/lxc/lxd/lxc/config"
 	"github.com/lxc/lxd/shared"
-	"github.com/lxc/lxd/shared/api"
 	"github.com/pborman/uuid"
+	"golang.org/x/crypto/ssh"
 )
 
 type Feedback struct {
@@ -67,7 +68,7 @@ func restFeedbackPostHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get the container
-	sessionId, _, _, _, _, sessionExpiry, err := dbGetContainer(id, false)
+	sessionId, _, _, _, sessionExpiry, err := db.GetContainer(id, false)
 	if err != nil || sessionId == -1 {
 		http.Error(w, "Session not found", 404)
 		return
@@ -88,7 +89,7 @@ func restFeedbackPostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = dbRecordFeedback(sessionId, feedback)
+	err = db.RecordFeedback(sessionId, feedback)
 	if err != nil {
 		http.Error(w, "Unable to record feedback data", 500)
 		return
@@ -109,14 +110,14 @@ func restFeedbackGetHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get the container
-	sessionId, _, _, _, _, _, err := dbGetContainer(id, false)
+	sessionId, _, _, _, _, err := db.GetContainer(id, false)
 	if err != nil || sessionId == -1 {
 		http.Error(w, "Session not found", 404)
 		return
 	}
 
 	// Get the feedback
-	feedbackId, feedbackRating, feedbackEmail, feedbackEmailUse, feedbackComment, err := dbGetFeedback(sessionId)
+	feedbackId, feedbackRating, feedbackEmail, feedbackEmailUse, feedbackComment, err := db.GetFeedback(sessionId)
 	if err != nil || feedbackId == -1 {
 		http.Error(w, "No existing feedback", 404)
 		return
@@ -161,13 +162,18 @@ func restStatusHandler(w http.ResponseWriter, r *http.Request) {
 	var containersCount int
 	var containersNext int
 
-	containersCount, err = dbActiveCount()
+	containersCount, err = db.ActiveCount()
 	if err != nil {
 		failure = true
 	}
 
-	if containersCount >= config.ServerContainersMax {
-		containersNext, err = dbNextExpire()
+	reserved, err := db.Reserved(time.Now().Unix())
+	if err != nil {
+		failure = true
+	}
+
+	if containersCount+reserved >= config.ServerContainersMax {
+		containersNext, err = db.NextExpire()
 		if err != nil {
 			failure = true
 		}
@@ -178,8 +184,11 @@ func restStatusHandler(w http.ResponseWriter, r *http.Request) {
 	body["client_address"] = address
 	body["client_protocol"] = protocol
 	body["feedback"] = config.Feedback
+	body["login_required"] = config.OIDCIssuer != ""
 	body["server_console_only"] = config.ServerConsoleOnly
 	body["server_ipv6_only"] = config.ServerIPv6Only
+	body["server_ssh_gateway"] = config.ServerSSHAddr != ""
+	body["server_ssh_keys_only"] = config.ServerSSHKeysOnly
 	if !config.ServerMaintenance && !failure {
 		body["server_status"] = serverOperational
 	} else {
@@ -188,6 +197,14 @@ func restStatusHandler(w http.ResponseWriter, r *http.Request) {
 	body["containers_count"] = containersCount
 	body["containers_max"] = config.ServerContainersMax
 	body["containers_next"] = containersNext
+	body["containers_reserved"] = reserved
+
+	environments := []string{}
+	for name := range config.Environments {
+		environments = append(environments, name)
+	}
+	sort.Strings(environments)
+	body["environments"] = environments
 
 	err = json.NewEncoder(w).Encode(body)
 	if err != nil {
@@ -246,7 +263,7 @@ func restStatisticsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Query the database
-	count, err := dbGetStats(statsPeriod, statsUnique, statsNetwork)
+	count, err := db.GetStats(statsPeriod, statsUnique, statsNetwork)
 	if err != nil {
 		http.Error(w, "Unable to retrieve statistics", 500)
 		return
@@ -296,263 +313,275 @@ func restStartHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check Terms of Service
-	requestTerms := r.FormValue("terms")
-	if requestTerms == "" {
-		http.Error(w, "Missing terms hash", 400)
-		return
-	}
-
-	if requestTerms != config.serverTermsHash {
-		restStartError(w, nil, containerInvalidTerms)
-		return
-	}
+	// Check the API token
+	var requestToken int64
+	tokenQuota := 0
+	tokenEnvironments := []string{}
+	tokenLifetime := 0
 
-	// Check for banned users
-	if shared.StringInSlice(requestIP, config.ServerBannedIPs) {
-		restStartError(w, nil, containerUserBanned)
-		return
-	}
+	authorization := r.Header.Get("Authorization")
+	if authorization != "" {
+		if !strings.HasPrefix(authorization, "Bearer ") {
+			restStartError(w, nil, containerInvalidToken)
+			return
+		}
 
-	// Count running containers
-	containersCount, err := dbActiveCount()
-	if err != nil {
-		containersCount = config.ServerContainersMax
-	}
+		requestToken, tokenQuota, tokenEnvironments, tokenLifetime, err = db.GetToken(tokenHash(strings.TrimPrefix(authorization, "Bearer ")))
+		if err != nil {
+			restStartError(w, err, containerUnknownError)
+			return
+		}
 
-	// Server is full
-	if containersCount >= config.ServerContainersMax {
-		restStartError(w, nil, containerServerFull)
-		return
+		if requestToken == 0 {
+			restStartError(w, nil, containerInvalidToken)
+			return
+		}
 	}
 
-	// Count container for requestor IP
-	containersCount, err = dbActiveCountForIP(requestIP)
-	if err != nil {
-		containersCount = config.QuotaSessions
-	}
+	// Check Terms of Service, accepted by the operator for token holders
+	requestTerms := r.FormValue("terms")
+	if requestToken == 0 {
+		if requestTerms == "" {
+			http.Error(w, "Missing terms hash", 400)
+			return
+		}
 
-	if config.QuotaSessions != 0 && containersCount >= config.QuotaSessions {
-		restStartError(w, nil, containerQuotaReached)
-		return
+		if requestTerms != config.serverTermsHash {
+			restStartError(w, nil, containerInvalidTerms)
+			return
+		}
 	}
 
-	// Create the container
-	containerName := fmt.Sprintf("tryit-%s", petname.Adjective())
-	containerUsername := petname.Adjective()
-	containerPassword := petname.Adjective()
-	id := uuid.NewRandom().String()
-
-	// Config
-	ctConfig := map[string]string{}
-
-	ctConfig["security.nesting"] = "true"
-	if config.QuotaCPU > 0 {
-		ctConfig["limits.cpu"] = fmt.Sprintf("%d", config.QuotaCPU)
-	}
+	// Check the workshop join code
+	var requestWorkshop int64
+	workshopCapacity := 0
+	var workshopEnd int64
 
-	if config.QuotaRAM > 0 {
-		ctConfig["limits.memory"] = fmt.Sprintf("%dMB", config.QuotaRAM)
-	}
+	requestEnvironment := r.FormValue("environment")
+	if r.FormValue("workshop") != "" && requestToken == 0 {
+		requestWorkshop, requestEnvironment, workshopCapacity, workshopEnd, err = workshopCheck(r.FormValue("workshop"))
+		if err != nil {
+			restStartError(w, err, containerUnknownError)
+			return
+		}
 
-	if config.QuotaProcesses > 0 {
-		ctConfig["limits.processes"] = fmt.Sprintf("%d", config.QuotaProcesses)
+		if requestWorkshop == 0 {
+			http.Error(w, "Invalid or closed workshop", 403)
+			return
+		}
 	}
 
-	if !config.ServerConsoleOnly {
-		ctConfig["user.user-data"] = fmt.Sprintf(`#cloud-config
-ssh_pwauth: True
-manage_etc_hosts: True
-users:
- - name: %s
-   groups: sudo
-   plain_text_passwd: %s
-   lock_passwd: False
-   shell: /bin/bash
-`, containerUsername, containerPassword)
-	}
-
-	var rop lxd.RemoteOperation
-	if config.Container != "" {
-		args := lxd.ContainerCopyArgs{
-			Name:          containerName,
-			ContainerOnly: true,
-		}
+	// Check the reservation code
+	var requestReservation int64
+	reservationSlots := 0
 
-		source, _, err := lxdDaemon.GetContainer(config.Container)
+	if r.FormValue("reservation") != "" && requestToken == 0 && requestWorkshop == 0 {
+		requestReservation, reservationSlots, err = reservationCheck(r.FormValue("reservation"))
 		if err != nil {
 			restStartError(w, err, containerUnknownError)
 			return
 		}
 
-		source.Config = ctConfig
-		source.Profiles = config.Profiles
-
-		rop, err = lxdDaemon.CopyContainer(lxdDaemon, *source, &args)
-		if err != nil {
-			restStartError(w, err, containerUnknownError)
+		if requestReservation == 0 {
+			http.Error(w, "Invalid or inactive reservation", 403)
 			return
 		}
-	} else {
-		defaultConfig := lxdconfig.DefaultConfig
+	}
 
-		remote, fingerprint, err := defaultConfig.ParseRemote(config.Image)
-		if err != nil {
-			restStartError(w, err, containerUnknownError)
+	// Check the environment
+	env, err := configEnvironment(requestEnvironment)
+	if err != nil {
+		http.Error(w, "Invalid environment", 400)
+		return
+	}
+
+	if requestToken != 0 && len(tokenEnvironments) > 0 {
+		name := requestEnvironment
+		if name == "" {
+			name = "default"
+		}
+
+		if !shared.StringInSlice(name, tokenEnvironments) {
+			http.Error(w, "Environment not allowed for this token", 403)
 			return
 		}
+	}
 
-		var d lxd.ImageServer
+	// Check the session lifetime
+	sessionTime := config.QuotaTime
+	if requestToken != 0 {
+		if tokenLifetime > 0 {
+			sessionTime = tokenLifetime
+		}
 
-		if remote == "local" {
-			d = lxdDaemon
-		} else {
-			d, err = defaultConfig.GetImageServer(remote)
-			if err != nil {
-				restStartError(w, err, containerUnknownError)
+		if r.FormValue("lifetime") != "" {
+			lifetime, err := strconv.Atoi(r.FormValue("lifetime"))
+			if err != nil || lifetime <= 0 {
+				http.Error(w, "Invalid lifetime", 400)
 				return
 			}
-		}
 
-		if fingerprint == "" {
-			fingerprint = "default"
+			if lifetime < sessionTime {
+				sessionTime = lifetime
+			}
 		}
+	}
 
-		alias, _, err := d.GetImageAlias(fingerprint)
-		if err == nil {
-			fingerprint = alias.Target
+	// Check the SSH key
+	requestSSHKey := ""
+	if !config.ServerConsoleOnly {
+		if r.FormValue("ssh_key") != "" {
+			requestSSHKey, err = restParseSSHKey(r.FormValue("ssh_key"))
+			if err != nil {
+				http.Error(w, "Invalid SSH key", 400)
+				return
+			}
+		} else if config.ServerSSHKeysOnly {
+			http.Error(w, "Missing SSH key", 400)
+			return
 		}
+	}
 
-		imgInfo, _, err := d.GetImage(fingerprint)
+	// Check the login
+	requestUser := ""
+	if config.OIDCIssuer != "" && requestToken == 0 {
+		requestUser, err = oidcUser(r)
 		if err != nil {
 			restStartError(w, err, containerUnknownError)
 			return
 		}
 
-		req := api.ContainersPost{
-			Name: containerName,
-		}
-		req.Config = ctConfig
-		req.Profiles = config.Profiles
-
-		rop, err = lxdDaemon.CreateContainerFromImage(d, *imgInfo, req)
-		if err != nil {
-			restStartError(w, err, containerUnknownError)
+		if requestUser == "" {
+			restStartError(w, nil, containerLoginNeeded)
 			return
 		}
 	}
 
-	err = rop.Wait()
-	if err != nil {
-		restStartError(w, err, containerUnknownError)
+	// Check for banned users
+	if shared.StringInSlice(requestIP, config.ServerBannedIPs) {
+		restStartError(w, nil, containerUserBanned)
 		return
 	}
 
-	// Configure the container devices
-	ct, etag, err := lxdDaemon.GetContainer(containerName)
+	if requestUser != "" && shared.StringInSlice(requestUser, config.ServerBannedUsers) {
+		restStartError(w, nil, containerUserBanned)
+		return
+	}
+
+	banned, err := db.IsBanned(requestIP, requestUser)
 	if err != nil {
-		lxdForceDelete(lxdDaemon, containerName)
 		restStartError(w, err, containerUnknownError)
 		return
 	}
 
-	if config.QuotaDisk > 0 {
-		_, ok := ct.ExpandedDevices["root"]
-		if ok {
-			ct.Devices["root"] = ct.ExpandedDevices["root"]
-			ct.Devices["root"]["size"] = fmt.Sprintf("%dGB", config.QuotaDisk)
-		} else {
-			ct.Devices["root"] = map[string]string{"type": "disk", "path": "/", "size": fmt.Sprintf("%dGB", config.QuotaDisk)}
-		}
+	if banned {
+		restStartError(w, nil, containerUserBanned)
+		return
 	}
 
-	op, err := lxdDaemon.UpdateContainer(containerName, ct.Writable(), etag)
+	// Count running containers
+	containersCount, err := db.ActiveCount()
 	if err != nil {
-		lxdForceDelete(lxdDaemon, containerName)
-		restStartError(w, err, containerUnknownError)
+		containersCount = config.ServerContainersMax
+	}
+
+	// Hold back the slots reserved for workshop attendees and reservations
+	if requestWorkshop == 0 && requestReservation == 0 {
+		reserved, err := db.Reserved(time.Now().Unix())
+		if err != nil {
+			reserved = config.ServerContainersMax
+		}
+
+		containersCount += reserved
+	}
+
+	// Server is full
+	if containersCount >= config.ServerContainersMax {
+		restStartError(w, nil, containerServerFull)
 		return
 	}
 
-	err = op.Wait()
+	// Count container for requestor (token, workshop, reservation, account or IP)
+	quotaSessions := config.QuotaSessions
+	if requestToken != 0 {
+		quotaSessions = tokenQuota
+		containersCount, err = db.ActiveCountForToken(requestToken)
+	} else if requestWorkshop != 0 {
+		quotaSessions = workshopCapacity
+		containersCount, err = db.ActiveCountForWorkshop(requestWorkshop)
+	} else if requestReservation != 0 {
+		quotaSessions = reservationSlots
+		containersCount, err = db.ActiveCountForReservation(requestReservation)
+	} else if requestUser != "" {
+		containersCount, err = db.ActiveCountForUser(requestUser)
+	} else {
+		containersCount, err = db.ActiveCountForIP(requestIP)
+	}
 	if err != nil {
-		lxdForceDelete(lxdDaemon, containerName)
-		restStartError(w, err, containerUnknownError)
-		return
+		containersCount = quotaSessions
 	}
 
-	// Start the container
-	req := api.ContainerStatePut{
-		Action:  "start",
-		Timeout: -1,
+	if quotaSessions != 0 && containersCount >= quotaSessions {
+		restStartError(w, nil, containerQuotaReached)
+		return
 	}
 
-	op, err = lxdDaemon.UpdateContainerState(containerName, req, "")
+	// Create the container
+	containerName, err := containerNameGenerate()
 	if err != nil {
-		lxdForceDelete(lxdDaemon, containerName)
 		restStartError(w, err, containerUnknownError)
 		return
 	}
 
-	err = op.Wait()
+	containerUsername, err := credentialsUsername()
 	if err != nil {
-		lxdForceDelete(lxdDaemon, containerName)
 		restStartError(w, err, containerUnknownError)
 		return
 	}
 
-	// Get the IP (30s timeout)
-	var containerIP string
-	if !config.ServerConsoleOnly {
-		time.Sleep(2 * time.Second)
-		timeout := 30
-		for timeout != 0 {
-			timeout--
-			ct, _, err := lxdDaemon.GetContainerState(containerName)
-			if err != nil {
-				lxdForceDelete(lxdDaemon, containerName)
-				restStartError(w, err, containerUnknownError)
-				return
-			}
-
-			for netName, net := range ct.Network {
-				if !shared.StringInSlice(netName, []string{"eth0", "lxcbr0"}) {
-					continue
-				}
-
-				for _, addr := range net.Addresses {
-					if addr.Address == "" {
-						continue
-					}
+	containerPassword, err := credentialsPassword()
+	if err != nil {
+		restStartError(w, err, containerUnknownError)
+		return
+	}
 
-					if addr.Scope != "global" {
-						continue
-					}
+	id := uuid.NewRandom().String()
 
-					if config.ServerIPv6Only && addr.Family != "inet6" {
-						continue
-					}
+	proxyToken, err := randomHex(16)
+	if err != nil {
+		restStartError(w, err, containerUnknownError)
+		return
+	}
 
-					containerIP = addr.Address
-					break
-				}
+	// Workshop sessions end with the workshop
+	if workshopEnd != 0 && time.Now().Unix()+int64(sessionTime) > workshopEnd {
+		sessionTime = int(workshopEnd - time.Now().Unix())
+	}
 
-				if containerIP != "" {
-					break
-				}
-			}
+	containerExpiry := time.Now().Unix() + int64(sessionTime)
 
-			if containerIP != "" {
-				break
-			}
+	session := cloudInitData{
+		Expiry:    containerExpiry,
+		Password:  containerPassword,
+		SessionID: id,
+		SSHKey:    requestSSHKey,
+		Username:  containerUsername,
+	}
 
-			time.Sleep(500 * time.Millisecond)
-		}
-	} else {
-		containerIP = "console-only"
+	containerIP, err := containerCreate(env, containerName, session)
+	if err != nil {
+		restStartError(w, err, containerUnknownError)
+		return
 	}
 
-	containerExpiry := time.Now().Unix() + int64(config.QuotaTime)
+	err = containerProvision(env, containerName)
+	if err != nil {
+		lxdForceDelete(lxdDaemon, containerName)
+		restStartError(w, err, containerProvisionFailed)
+		return
+	}
 
+	// The password isn't stored, this is the only time the client gets it
 	if !config.ServerConsoleOnly {
 		body["ip"] = containerIP
 		body["username"] = containerUsername
@@ -561,16 +590,19 @@ users:
 	}
 	body["id"] = id
 	body["expiry"] = containerExpiry
+	if len(config.ServerProxyPorts) > 0 {
+		body["proxy_token"] = proxyToken
+	}
 
 	// Setup cleanup code
-	duration, err := time.ParseDuration(fmt.Sprintf("%ds", config.QuotaTime))
+	duration, err := time.ParseDuration(fmt.Sprintf("%ds", containerExpiry-time.Now().Unix()))
 	if err != nil {
 		lxdForceDelete(lxdDaemon, containerName)
 		restStartError(w, err, containerUnknownError)
 		return
 	}
 
-	containerID, err := dbNew(id, containerName, containerIP, containerUsername, containerPassword, containerExpiry, requestDate, requestIP, requestTerms)
+	containerID, err := db.New(id, proxyToken, containerName, containerIP, containerUsername, containerExpiry, requestDate, requestIP, requestUser, requestToken, requestWorkshop, requestReservation, requestTerms, requestEnvironment)
 	if err != nil {
 		lxdForceDelete(lxdDaemon, containerName)
 		restStartError(w, err, containerUnknownError)
@@ -578,8 +610,7 @@ users:
 	}
 
 	time.AfterFunc(duration, func() {
-		lxdForceDelete(lxdDaemon, containerName)
-		dbExpire(containerID)
+		containerExpire(containerID, containerName)
 	})
 
 	// Return to the client
@@ -609,7 +640,7 @@ func restInfoHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get the container
-	sessionId, containerName, containerIP, containerUsername, containerPassword, containerExpiry, err := dbGetContainer(id, false)
+	sessionId, containerName, containerIP, containerUsername, containerExpiry, err := db.GetContainer(id, false)
 	if err != nil || sessionId == -1 {
 		http.Error(w, "Session not found", 404)
 		return
@@ -620,12 +651,21 @@ func restInfoHandler(w http.ResponseWriter, r *http.Request) {
 	if !config.ServerConsoleOnly {
 		body["ip"] = containerIP
 		body["username"] = containerUsername
-		body["password"] = containerPassword
 		body["fqdn"] = fmt.Sprintf("%s.lxd", containerName)
 	}
 	body["id"] = id
 	body["expiry"] = containerExpiry
 
+	if len(config.ServerProxyPorts) > 0 {
+		proxyToken, err := db.GetProxyToken(sessionId)
+		if err != nil {
+			http.Error(w, "Internal server error", 500)
+			return
+		}
+
+		body["proxy_token"] = proxyToken
+	}
+
 	// Return to the client
 	body["status"] = containerStarted
 	err = json.NewEncoder(w).Encode(body)
@@ -636,6 +676,127 @@ func restInfoHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func restResetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get the id
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "Missing session id", 400)
+		return
+	}
+
+	// Get the container
+	sessionId, containerName, _, containerUsername, containerExpiry, err := db.GetContainer(id, true)
+	if err != nil || sessionId == -1 {
+		http.Error(w, "Session not found", 404)
+		return
+	}
+
+	sessionEnv, err := sessionEnvironment(sessionId)
+	if err != nil {
+		restStartError(w, err, containerUnknownError)
+		return
+	}
+
+	// Check the SSH key
+	requestSSHKey := ""
+	if !config.ServerConsoleOnly {
+		if r.FormValue("ssh_key") != "" {
+			requestSSHKey, err = restParseSSHKey(r.FormValue("ssh_key"))
+			if err != nil {
+				http.Error(w, "Invalid SSH key", 400)
+				return
+			}
+		} else if config.ServerSSHKeysOnly {
+			http.Error(w, "Missing SSH key", 400)
+			return
+		}
+	}
+
+	// Rate limiting
+	allowed, err := db.ClaimReset(sessionId, time.Now().Unix()-int64(config.QuotaResetInterval))
+	if err != nil {
+		restStartError(w, err, containerUnknownError)
+		return
+	}
+
+	if !allowed {
+		http.Error(w, "Session was reset too recently", 429)
+		return
+	}
+
+	// Replace the container, the old password went with it
+	containerPassword, err := credentialsPassword()
+	if err != nil {
+		restStartError(w, err, containerUnknownError)
+		return
+	}
+
+	err = lxdForceDelete(lxdDaemon, containerName)
+	if err != nil {
+		restStartError(w, err, containerUnknownError)
+		return
+	}
+
+	proxyForget(containerName)
+
+	session := cloudInitData{
+		Expiry:    containerExpiry,
+		Password:  containerPassword,
+		SessionID: id,
+		SSHKey:    requestSSHKey,
+		Username:  containerUsername,
+	}
+
+	containerIP, err := containerCreate(sessionEnv, containerName, session)
+	if err != nil {
+		db.Expire(sessionId)
+		restStartError(w, err, containerUnknownError)
+		return
+	}
+
+	err = containerProvision(sessionEnv, containerName)
+	if err != nil {
+		lxdForceDelete(lxdDaemon, containerName)
+		db.Expire(sessionId)
+		restStartError(w, err, containerProvisionFailed)
+		return
+	}
+
+	err = db.Reset(sessionId, containerIP)
+	if err != nil {
+		restStartError(w, err, containerUnknownError)
+		return
+	}
+
+	// Generate the response
+	body := make(map[string]interface{})
+
+	if !config.ServerConsoleOnly {
+		body["ip"] = containerIP
+		body["username"] = containerUsername
+		body["password"] = containerPassword
+		body["fqdn"] = fmt.Sprintf("%s.lxd", containerName)
+	}
+	body["id"] = id
+	body["expiry"] = containerExpiry
+
+	// Return to the client
+	body["status"] = containerStarted
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
+
 func restStartError(w http.ResponseWriter, err error, code statusCode) {
 	body := make(map[string]interface{})
 	body["status"] = code
@@ -651,6 +812,17 @@ func restStartError(w http.ResponseWriter, err error, code statusCode) {
 	}
 }
 
+// restParseSSHKey validates a SSH public key and returns it in its
+// canonical form, without any comment or options.
+func restParseSSHKey(key string) (string, error) {
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))), nil
+}
+
 func restClientIP(r *http.Request) (string, string, error) {
 	var address string
 	var protocol string
@@ -699,12 +871,18 @@ func restConsoleHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get the container
-	sessionId, containerName, _, _, _, _, err := dbGetContainer(id, true)
+	sessionId, containerName, _, containerUsername, _, err := db.GetContainer(id, true)
 	if err != nil || sessionId == -1 {
 		http.Error(w, "Session not found", 404)
 		return
 	}
 
+	sessionEnv, err := sessionEnvironment(sessionId)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
 	// Get console width and height
 	width := r.FormValue("width")
 	height := r.FormValue("height")
@@ -744,14 +922,20 @@ func restConsoleHandler(w http.ResponseWriter, r *http.Request) {
 	defer conn.Close()
 
 	// Connect to the container
-	env := make(map[string]string)
-	env["USER"] = "root"
-	env["HOME"] = "/root"
-	env["TERM"] = "xterm"
-
 	inRead, inWrite := io.Pipe()
 	outRead, outWrite := io.Pipe()
 
+	var writeLock sync.Mutex
+
+	// idle warnings
+	detach := consoleAttach(sessionId, func(msg string) error {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+
+		return conn.WriteMessage(websocket.TextMessage, []byte(msg))
+	})
+	defer detach()
+
 	// read handler
 	go func(conn *websocket.Conn, r io.Reader) {
 		in := shared.ReaderToChannel(r, -1)
@@ -762,7 +946,11 @@ func restConsoleHandler(w http.ResponseWriter, r *http.Request) {
 				break
 			}
 
-			err = conn.WriteMessage(websocket.TextMessage, buf)
+			consoleTouch(sessionId)
+
+			writeLock.Lock()
+			err := conn.WriteMessage(websocket.TextMessage, buf)
+			writeLock.Unlock()
 			if err != nil {
 				break
 			}
@@ -770,7 +958,16 @@ func restConsoleHandler(w http.ResponseWriter, r *http.Request) {
 	}(conn, outRead)
 
 	// write handler
+	var auditor *consoleAuditor
+	if config.ServerConsoleAudit != "" {
+		auditor = &consoleAuditor{sessionId: sessionId, mode: config.ServerConsoleAudit}
+	}
+
 	go func(conn *websocket.Conn, w io.Writer) {
+		if auditor != nil {
+			defer auditor.flush()
+		}
+
 		for {
 			mt, payload, err := conn.ReadMessage()
 			if err != nil {
@@ -783,6 +980,11 @@ func restConsoleHandler(w http.ResponseWriter, r *http.Request) {
 			case websocket.BinaryMessage:
 				continue
 			case websocket.TextMessage:
+				consoleTouch(sessionId)
+				if auditor != nil {
+					auditor.write(payload)
+				}
+
 				w.Write(payload)
 			default:
 				break
@@ -800,15 +1002,15 @@ func restConsoleHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	req := api.ContainerExecPost{
-		Command:     config.Command,
-		WaitForWS:   true,
-		Interactive: true,
-		Environment: env,
-		Width:       widthInt,
-		Height:      heightInt,
+	req, err := consoleExecPost(sessionEnv, containerName, containerUsername, r.FormValue("term"))
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
 	}
 
+	req.Width = widthInt
+	req.Height = heightInt
+
 	execArgs := lxd.ContainerExecArgs{
 		Stdin:    inRead,
 		Stdout:   outWrite,
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// retentionRun periodically anonymizes and deletes old session records
+// according to the retention configuration.
+func retentionRun() {
+	for {
+		err := retentionApply()
+		if err != nil {
+			fmt.Printf("Failed to apply data retention: %s\n", err)
+		}
+
+		time.Sleep(time.Hour)
+	}
+}
+
+func retentionApply() error {
+	day := int64(24 * 60 * 60)
+	now := time.Now().Unix()
+
+	if config.RetentionAnonymize > 0 {
+		_, err := db.Anonymize(now-int64(config.RetentionAnonymize)*day, retentionAnonymizeIP)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.RetentionDelete > 0 {
+		_, err := db.Prune(now - int64(config.RetentionDelete)*day)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// retentionAnonymizeIP returns what's left of a client address once
+// anonymized, either its network prefix or its keyed hash.
+func retentionAnonymizeIP(ip string, hash string) string {
+	if config.RetentionIPMode == "hash" {
+		return hash
+	}
+
+	netIP := net.ParseIP(ip)
+	if netIP == nil {
+		return hash
+	}
+
+	if netIP.To4() != nil {
+		return netIP.Mask(net.CIDRMask(config.RetentionIPv4Mask, 32)).String()
+	}
+
+	return netIP.Mask(net.CIDRMask(config.RetentionIPv6Mask, 128)).String()
+}
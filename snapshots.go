@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/lxc/lxd/shared/api"
+)
+
+func restSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	if config.QuotaSnapshots == 0 {
+		http.Error(w, "Snapshots are disabled", 400)
+		return
+	}
+
+	if r.Method == "GET" {
+		restSnapshotsGetHandler(w, r)
+		return
+	}
+
+	if r.Method == "POST" {
+		restSnapshotsPostHandler(w, r)
+		return
+	}
+
+	if r.Method == "OPTIONS" {
+		origin := r.Header.Get("Origin")
+		if origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		}
+
+		return
+	}
+
+	http.Error(w, "Not implemented", 501)
+}
+
+func restSnapshotsGetHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get the id argument
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "Missing session id", 400)
+		return
+	}
+
+	// Get the container
+	sessionId, _, _, _, _, err := db.GetContainer(id, true)
+	if err != nil || sessionId == -1 {
+		http.Error(w, "Session not found", 404)
+		return
+	}
+
+	// Get the snapshots
+	snapshots, err := db.GetSnapshots(sessionId)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	// Generate the response
+	entries := []map[string]interface{}{}
+	for _, snapshot := range snapshots {
+		entries = append(entries, map[string]interface{}{
+			"name": snapshot[0].(string),
+			"date": snapshot[1].(int),
+		})
+	}
+
+	body := make(map[string]interface{})
+	body["snapshots"] = entries
+	body["max"] = config.QuotaSnapshots
+
+	// Return to the client
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
+
+func restSnapshotsPostHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get the id argument
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "Missing session id", 400)
+		return
+	}
+
+	// Get the container
+	sessionId, containerName, _, _, _, err := db.GetContainer(id, true)
+	if err != nil || sessionId == -1 {
+		http.Error(w, "Session not found", 404)
+		return
+	}
+
+	// Check the quotas
+	snapshots, err := db.GetSnapshots(sessionId)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	if len(snapshots) >= config.QuotaSnapshots {
+		http.Error(w, "Snapshot quota reached", 403)
+		return
+	}
+
+	state, _, err := lxdDaemon.GetContainerState(containerName)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	// The snapshot sizes are estimated from the disk usage at the time
+	// they were taken, the container and its snapshots must fit in the disk quota.
+	usage := state.Disk["root"].Usage
+	if config.QuotaDisk > 0 {
+		total := usage * 2
+		for _, snapshot := range snapshots {
+			total += int64(snapshot[2].(int))
+		}
+
+		if total > int64(config.QuotaDisk)*1000*1000*1000 {
+			http.Error(w, "Disk quota reached", 403)
+			return
+		}
+	}
+
+	// Create the snapshot
+	name := fmt.Sprintf("snap%d", len(snapshots))
+	op, err := lxdDaemon.CreateContainerSnapshot(containerName, api.ContainerSnapshotsPost{Name: name})
+	if err != nil {
+		http.Error(w, "Unable to create the snapshot", 500)
+		return
+	}
+
+	err = op.Wait()
+	if err != nil {
+		http.Error(w, "Unable to create the snapshot", 500)
+		return
+	}
+
+	err = db.NewSnapshot(sessionId, name, usage)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	// Return to the client
+	body := make(map[string]interface{})
+	body["name"] = name
+
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
+
+func restRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if config.QuotaSnapshots == 0 {
+		http.Error(w, "Snapshots are disabled", 400)
+		return
+	}
+
+	// Get the arguments
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "Missing session id", 400)
+		return
+	}
+
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "Missing snapshot name", 400)
+		return
+	}
+
+	// Get the container
+	sessionId, containerName, _, _, _, err := db.GetContainer(id, true)
+	if err != nil || sessionId == -1 {
+		http.Error(w, "Session not found", 404)
+		return
+	}
+
+	// Check that the snapshot belongs to the session
+	snapshots, err := db.GetSnapshots(sessionId)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	found := false
+	for _, snapshot := range snapshots {
+		if snapshot[0].(string) == name {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		http.Error(w, "Snapshot not found", 404)
+		return
+	}
+
+	// Restore the snapshot
+	op, err := lxdDaemon.UpdateContainer(containerName, api.ContainerPut{Restore: name}, "")
+	if err != nil {
+		http.Error(w, "Unable to restore the snapshot", 500)
+		return
+	}
+
+	err = op.Wait()
+	if err != nil {
+		http.Error(w, "Unable to restore the snapshot", 500)
+		return
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lxc/lxd/client"
+	"github.com/lxc/lxd/shared/api"
+	"golang.org/x/crypto/ssh"
+)
+
+type sshPtyRequest struct {
+	Term    string
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+	Modes   string
+}
+
+type sshWindowChange struct {
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+}
+
+// sshSetup starts the SSH gateway giving access to the session containers,
+// users log in with their session id as the password.
+func sshSetup() error {
+	hostKey, err := sshHostKey("lxd-demo.ssh_host_key")
+	if err != nil {
+		return fmt.Errorf("Unable to load the SSH host key: %s", err)
+	}
+
+	sshConfig := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			sessionId, containerName, _, containerUsername, _, err := db.GetContainer(string(password), true)
+			if err != nil || sessionId == -1 {
+				return nil, fmt.Errorf("Session not found")
+			}
+
+			environmentName, err := db.GetEnvironment(sessionId)
+			if err != nil {
+				return nil, fmt.Errorf("Session not found")
+			}
+
+			return &ssh.Permissions{Extensions: map[string]string{"session": strconv.FormatInt(sessionId, 10), "container": containerName, "environment": environmentName, "username": containerUsername}}, nil
+		},
+	}
+	sshConfig.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", config.ServerSSHAddr)
+	if err != nil {
+		return fmt.Errorf("Unable to setup the SSH listener: %s", err)
+	}
+
+	go sshServe(listener, sshConfig)
+
+	return nil
+}
+
+// sshServe accepts connections until the listener fails for good (or gets
+// closed).
+func sshServe(listener net.Listener, sshConfig *ssh.ServerConfig) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Printf("SSH accept error: %s\n", err)
+
+			netErr, ok := err.(net.Error)
+			if ok && netErr.Temporary() && !errors.Is(err, net.ErrClosed) {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+
+			return
+		}
+
+		go sshHandleConn(conn, sshConfig)
+	}
+}
+
+func sshHostKey(path string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		return ssh.ParsePrivateKey(data)
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Generate a new host key
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := ssh.MarshalPrivateKey(privateKey, "")
+	if err != nil {
+		return nil, err
+	}
+
+	err = ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.NewSignerFromKey(privateKey)
+}
+
+func sshHandleConn(netConn net.Conn, sshConfig *ssh.ServerConfig) {
+	conn, channels, requests, err := ssh.NewServerConn(netConn, sshConfig)
+	if err != nil {
+		netConn.Close()
+		return
+	}
+	defer conn.Close()
+
+	go ssh.DiscardRequests(requests)
+
+	sessionId, err := strconv.ParseInt(conn.Permissions.Extensions["session"], 10, 64)
+	if err != nil {
+		return
+	}
+
+	containerName := conn.Permissions.Extensions["container"]
+	env, err := configEnvironment(conn.Permissions.Extensions["environment"])
+	if err != nil {
+		return
+	}
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "Unsupported channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		go sshHandleSession(channel, requests, sessionId, containerName, env, conn.Permissions.Extensions["username"])
+	}
+}
+
+func sshHandleSession(channel ssh.Channel, requests <-chan *ssh.Request, sessionId int64, containerName string, env environment, containerUsername string) {
+	var lock sync.Mutex
+	var control *websocket.Conn
+
+	term := "xterm"
+	width := 80
+	height := 24
+	started := false
+
+	for req := range requests {
+		switch req.Type {
+		case "pty-req":
+			pty := sshPtyRequest{}
+			err := ssh.Unmarshal(req.Payload, &pty)
+			if err != nil || started {
+				req.Reply(false, nil)
+				continue
+			}
+
+			term = pty.Term
+			width = int(pty.Columns)
+			height = int(pty.Rows)
+			req.Reply(true, nil)
+		case "window-change":
+			size := sshWindowChange{}
+			err := ssh.Unmarshal(req.Payload, &size)
+			if err != nil {
+				continue
+			}
+
+			lock.Lock()
+			width = int(size.Columns)
+			height = int(size.Rows)
+			if control != nil {
+				sshResize(control, width, height)
+			}
+			lock.Unlock()
+		case "shell":
+			if started {
+				req.Reply(false, nil)
+				continue
+			}
+
+			started = true
+			req.Reply(true, nil)
+
+			go func(term string, width int, height int) {
+				handler := func(conn *websocket.Conn) {
+					lock.Lock()
+					control = conn
+					lock.Unlock()
+
+					for {
+						_, _, err := conn.ReadMessage()
+						if err != nil {
+							break
+						}
+					}
+
+					lock.Lock()
+					control = nil
+					lock.Unlock()
+				}
+
+				// idle warnings
+				detach := consoleAttach(sessionId, func(msg string) error {
+					_, err := channel.Write([]byte(msg))
+					return err
+				})
+
+				status := 255
+				execPost, err := consoleExecPost(env, containerName, containerUsername, term)
+				if err != nil {
+					fmt.Fprintf(channel, "%s\r\n", err)
+				} else {
+					status = sshExec(channel, sessionId, containerName, execPost, width, height, handler)
+				}
+
+				detach()
+
+				channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+				channel.Close()
+			}(term, width, height)
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func sshResize(conn *websocket.Conn, width int, height int) error {
+	msg := api.ContainerExecControl{
+		Command: "window-resize",
+		Args: map[string]string{
+			"width":  fmt.Sprintf("%d", width),
+			"height": fmt.Sprintf("%d", height),
+		},
+	}
+
+	return conn.WriteJSON(msg)
+}
+
+func sshExec(channel ssh.Channel, sessionId int64, containerName string, req api.ContainerExecPost, width int, height int, handler func(conn *websocket.Conn)) int {
+	req.Width = width
+	req.Height = height
+
+	input := &consoleInput{ReadCloser: channel, sessionId: sessionId}
+	if config.ServerConsoleAudit != "" {
+		input.auditor = &consoleAuditor{sessionId: sessionId, mode: config.ServerConsoleAudit}
+	}
+	defer input.flush()
+
+	output := &consoleOutput{WriteCloser: channel, sessionId: sessionId}
+
+	execArgs := lxd.ContainerExecArgs{
+		Stdin:    input,
+		Stdout:   output,
+		Stderr:   output,
+		Control:  handler,
+		DataDone: make(chan bool),
+	}
+
+	op, err := lxdDaemon.ExecContainer(containerName, req, &execArgs)
+	if err != nil {
+		return 255
+	}
+
+	err = op.Wait()
+	if err != nil {
+		return 255
+	}
+
+	<-execArgs.DataDone
+
+	status, ok := op.Get().Metadata["return"].(float64)
+	if !ok {
+		return 255
+	}
+
+	return int(status)
+}
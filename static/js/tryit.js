@@ -31,6 +31,23 @@ $(document).ready(function() {
         return ""
     };
 
+    // The server doesn't keep the container password, remember it locally
+    function tryitSavePassword(id, password) {
+        try {
+            window.localStorage.setItem("tryit_password_"+id, password);
+        } catch (e) {
+            return
+        }
+    };
+
+    function tryitLoadPassword(id) {
+        try {
+            return window.localStorage.getItem("tryit_password_"+id) || "";
+        } catch (e) {
+            return ""
+        }
+    };
+
     function getTimeRemaining(endtime){
         var current = Math.floor(new Date() / 1000);
         var remaining = endtime - current;
@@ -223,7 +240,7 @@ $(document).ready(function() {
                 $('.tryit_container_ip').text(data.ip);
                 $('.tryit_container_fqdn').text(data.fqdn);
                 $('.tryit_container_username').text(data.username);
-                $('.tryit_container_password').text(data.password);
+                $('.tryit_container_password').text(tryitLoadPassword(data.id));
 
                 initializeClock('tryit_clock', data.expiry);
 
@@ -261,6 +278,11 @@ $(document).ready(function() {
                     return
                 }
 
+                if (data.status == 6) {
+                    window.location.href = "http://"+tryit_server+"/1.0/login";
+                    return
+                }
+
                 $('#tryit_start_panel').css("display", "none");
                 if (data.status == 2) {
                     $('#tryit_error_full').css("display", "inherit");
@@ -274,6 +296,9 @@ $(document).ready(function() {
                 else if (data.status == 5) {
                     $('#tryit_error_unknown').css("display", "inherit");
                 }
+                else if (data.status == 7) {
+                    $('#tryit_error_provision').css("display", "inherit");
+                }
                 $('#tryit_error_panel_create').css("display", "inherit");
                 $('#tryit_error_panel').css("display", "inherit");
                 return
@@ -284,6 +309,7 @@ $(document).ready(function() {
             $('.tryit_container_fqdn').text(data.fqdn);
             $('.tryit_container_username').text(data.username);
             $('.tryit_container_password').text(data.password);
+            tryitSavePassword(data.id, data.password);
             initializeClock('tryit_clock', data.expiry);
 
             $('#tryit_status_panel').css("display", "none");
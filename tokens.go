@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/lxc/lxd/shared"
+)
+
+type tokenPost struct {
+	Name          string   `json:"name"`
+	QuotaSessions int      `json:"quota_sessions"`
+	Environments  []string `json:"environments"`
+	MaxLifetime   int      `json:"max_lifetime"`
+}
+
+// tokenHash returns the form in which API tokens are stored.
+func tokenHash(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+// restAdminAuth checks the admin key of a request, replying on failure.
+func restAdminAuth(w http.ResponseWriter, r *http.Request) bool {
+	requestKey := r.FormValue("key")
+	if requestKey == "" || !shared.StringInSlice(requestKey, config.ServerAdminKeys) {
+		http.Error(w, "Invalid authentication key", 401)
+		return false
+	}
+
+	return true
+}
+
+func restAdminTokensHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !restAdminAuth(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		restAdminTokensGet(w, r)
+	case "POST":
+		restAdminTokensPost(w, r)
+	case "DELETE":
+		restAdminTokensDelete(w, r)
+	default:
+		http.Error(w, "Not implemented", 501)
+	}
+}
+
+func restAdminTokensGet(w http.ResponseWriter, r *http.Request) {
+	tokens, err := db.GetTokens()
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	body := []map[string]interface{}{}
+	for _, entry := range tokens {
+		environments := []string{}
+		if entry[2].(string) != "" {
+			environments = strings.Split(entry[2].(string), ",")
+		}
+
+		body = append(body, map[string]interface{}{
+			"name":           entry[0],
+			"quota_sessions": entry[1],
+			"environments":   environments,
+			"max_lifetime":   entry[3],
+			"created":        entry[4],
+			"revoked":        entry[5],
+		})
+	}
+
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
+
+func restAdminTokensPost(w http.ResponseWriter, r *http.Request) {
+	req := tokenPost{}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request", 400)
+		return
+	}
+
+	if req.Name == "" || strings.Contains(req.Name, ",") {
+		http.Error(w, "Invalid token name", 400)
+		return
+	}
+
+	if req.QuotaSessions <= 0 || req.MaxLifetime < 0 {
+		http.Error(w, "Invalid token limits", 400)
+		return
+	}
+
+	for _, name := range req.Environments {
+		if name == "default" {
+			continue
+		}
+
+		_, err := configEnvironment(name)
+		if err != nil || name == "" || strings.Contains(name, ",") {
+			http.Error(w, fmt.Sprintf("Invalid environment: %s", name), 400)
+			return
+		}
+	}
+
+	token, err := randomHex(32)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	err = db.NewToken(req.Name, tokenHash(token), req.QuotaSessions, req.Environments, req.MaxLifetime)
+	if err != nil {
+		http.Error(w, "Unable to create the token", 409)
+		return
+	}
+
+	// The token isn't stored, this is the only time the operator gets it
+	body := make(map[string]interface{})
+	body["name"] = req.Name
+	body["token"] = token
+
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
+
+func restAdminTokensDelete(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "Missing token name", 400)
+		return
+	}
+
+	revoked, err := db.RevokeToken(name)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	if !revoked {
+		http.Error(w, "Token not found", 404)
+		return
+	}
+}
+
+func restAdminTokensAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if !restAdminAuth(w, r) {
+		return
+	}
+
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "Missing token name", 400)
+		return
+	}
+
+	sessions, err := db.GetTokenSessions(name)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	body := []map[string]interface{}{}
+	for _, entry := range sessions {
+		body = append(body, map[string]interface{}{
+			"id":           entry[0],
+			"status":       entry[1],
+			"environment":  entry[2],
+			"request_date": entry[3],
+			"request_ip":   entry[4],
+		})
+	}
+
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminTokensPost(t *testing.T) {
+	defer dbTestGlobal(t)()
+
+	config = serverConfig{ServerAdminKeys: []string{"admin"}}
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"valid", `{"name": "ci", "quota_sessions": 5, "max_lifetime": 600}`, 200},
+		{"duplicate", `{"name": "ci", "quota_sessions": 5}`, 409},
+		{"no name", `{"quota_sessions": 5}`, 400},
+		{"no quota", `{"name": "nightly"}`, 400},
+		{"negative quota", `{"name": "nightly", "quota_sessions": -1}`, 400},
+		{"negative lifetime", `{"name": "nightly", "quota_sessions": 1, "max_lifetime": -1}`, 400},
+		{"unknown environment", `{"name": "nightly", "quota_sessions": 1, "environments": ["missing"]}`, 400},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/1.0/admin/tokens?key=admin", strings.NewReader(test.body))
+		rec := httptest.NewRecorder()
+		restAdminTokensHandler(rec, req)
+
+		if rec.Code != test.status {
+			t.Errorf("%s: got status %d, want %d: %s", test.name, rec.Code, test.status, rec.Body.String())
+		}
+	}
+}
+
+func TestStartToken(t *testing.T) {
+	defer dbTestGlobal(t)()
+
+	config = serverConfig{}
+
+	tests := []struct {
+		name          string
+		authorization string
+	}{
+		{"malformed header", "Basic dXNlcjpwYXNz"},
+		{"unknown token", "Bearer forged"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/1.0/start", nil)
+		req.Header.Set("Authorization", test.authorization)
+		rec := httptest.NewRecorder()
+		restStartHandler(rec, req)
+
+		body := map[string]interface{}{}
+		err := json.NewDecoder(rec.Body).Decode(&body)
+		if err != nil {
+			t.Errorf("%s: invalid response: %s", test.name, err)
+			continue
+		}
+
+		if body["status"] != float64(containerInvalidToken) {
+			t.Errorf("%s: got status %v, want %d", test.name, body["status"], containerInvalidToken)
+		}
+	}
+}
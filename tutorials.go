@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+type tutorialStep struct {
+	Title        string `yaml:"title"`
+	Instructions string `yaml:"instructions"`
+	Check        string `yaml:"check"`
+}
+
+type tutorial struct {
+	Title string         `yaml:"title"`
+	Steps []tutorialStep `yaml:"steps"`
+}
+
+// tutorialsLoad parses the tutorials (one YAML file each) found in the
+// configured directory, named after their file.
+func tutorialsLoad() (map[string]tutorial, error) {
+	tutorials := map[string]tutorial{}
+	if config.Tutorials == "" {
+		return tutorials, nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(config.Tutorials, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".yaml")
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read tutorial %s: %s", name, err)
+		}
+
+		entry := tutorial{}
+		err = yaml.Unmarshal(data, &entry)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse tutorial %s: %s", name, err)
+		}
+
+		if len(entry.Steps) == 0 {
+			return nil, fmt.Errorf("Tutorial %s has no steps", name)
+		}
+
+		for i, step := range entry.Steps {
+			if step.Check == "" {
+				return nil, fmt.Errorf("Step %d of tutorial %s has no check", i+1, name)
+			}
+		}
+
+		tutorials[name] = entry
+	}
+
+	return tutorials, nil
+}
+
+func restTutorialsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	names := []string{}
+	for name := range config.tutorials {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	body := []map[string]interface{}{}
+	for _, name := range names {
+		body = append(body, map[string]interface{}{
+			"name":  name,
+			"title": config.tutorials[name].Title,
+			"steps": len(config.tutorials[name].Steps),
+		})
+	}
+
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
+
+func restTutorialHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get the id
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "Missing session id", 400)
+		return
+	}
+
+	// Get the tutorial
+	name := r.FormValue("name")
+	entry, ok := config.tutorials[name]
+	if !ok {
+		http.Error(w, "Tutorial not found", 404)
+		return
+	}
+
+	// Get the container
+	sessionId, containerName, _, _, _, err := db.GetContainer(id, true)
+	if err != nil || sessionId == -1 {
+		http.Error(w, "Session not found", 404)
+		return
+	}
+
+	step, err := db.GetTutorialStep(sessionId, name)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	// Record the session as having started the tutorial
+	if step == -1 {
+		step = 0
+
+		err = db.SetTutorialStep(sessionId, name, step)
+		if err != nil {
+			http.Error(w, "Internal server error", 500)
+			return
+		}
+	}
+
+	body := make(map[string]interface{})
+
+	if r.Method == "POST" {
+		if step >= len(entry.Steps) {
+			http.Error(w, "Tutorial already completed", 400)
+			return
+		}
+
+		// Run the check for the current step
+		status, output, err := lxdExec(lxdDaemon, containerName, []string{"sh", "-c", entry.Steps[step].Check}, nil, 10*time.Second)
+		body["passed"] = err == nil && status == 0
+		body["output"] = output
+
+		if err == nil && status == 0 {
+			step++
+
+			err = db.SetTutorialStep(sessionId, name, step)
+			if err != nil {
+				http.Error(w, "Internal server error", 500)
+				return
+			}
+		}
+	} else {
+		steps := []map[string]interface{}{}
+		for _, s := range entry.Steps {
+			steps = append(steps, map[string]interface{}{
+				"title":        s.Title,
+				"instructions": s.Instructions,
+			})
+		}
+
+		body["name"] = name
+		body["title"] = entry.Title
+		body["steps"] = steps
+	}
+
+	body["step"] = step
+	body["completed"] = step >= len(entry.Steps)
+
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
+
+func restAdminTutorialsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if !restAdminAuth(w, r) {
+		return
+	}
+
+	stats, err := db.GetTutorialStats()
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	// Number of sessions having started the tutorial followed by the number
+	// having completed each step, the drop off being the difference between
+	// consecutive entries
+	body := map[string][]int{}
+	for name, entry := range config.tutorials {
+		body[name] = make([]int, len(entry.Steps)+1)
+	}
+
+	for _, row := range stats {
+		completed, ok := body[row[0].(string)]
+		if !ok {
+			continue
+		}
+
+		for i := 0; i <= row[1].(int) && i < len(completed); i++ {
+			completed[i] += row[2].(int)
+		}
+	}
+
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
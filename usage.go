@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lxc/lxd/shared/api"
+)
+
+type usageCacheEntry struct {
+	state  *api.ContainerState
+	expiry time.Time
+}
+
+var usageCacheLock sync.Mutex
+var usageCache = map[string]usageCacheEntry{}
+
+// usageGetState returns the container state, cached for a few seconds to
+// protect LXD from clients polling for usage.
+func usageGetState(containerName string) (*api.ContainerState, error) {
+	usageCacheLock.Lock()
+	defer usageCacheLock.Unlock()
+
+	now := time.Now()
+
+	entry, ok := usageCache[containerName]
+	if ok && now.Before(entry.expiry) {
+		return entry.state, nil
+	}
+
+	// Forget about stale entries
+	for name, entry := range usageCache {
+		if now.After(entry.expiry) {
+			delete(usageCache, name)
+		}
+	}
+
+	state, _, err := lxdDaemon.GetContainerState(containerName)
+	if err != nil {
+		return nil, err
+	}
+
+	usageCache[containerName] = usageCacheEntry{state: state, expiry: now.Add(5 * time.Second)}
+
+	return state, nil
+}
+
+func restUsageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get the id
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "Missing session id", 400)
+		return
+	}
+
+	// Get the container
+	sessionId, containerName, _, _, containerExpiry, err := db.GetContainer(id, true)
+	if err != nil || sessionId == -1 {
+		http.Error(w, "Session not found", 404)
+		return
+	}
+
+	state, err := usageGetState(containerName)
+	if err != nil {
+		http.Error(w, "Unable to retrieve the container state", 500)
+		return
+	}
+
+	// Generate the response
+	var bytesReceived int64
+	var bytesSent int64
+	for netName, net := range state.Network {
+		if netName == "lo" {
+			continue
+		}
+
+		bytesReceived += net.Counters.BytesReceived
+		bytesSent += net.Counters.BytesSent
+	}
+
+	remaining := containerExpiry - time.Now().Unix()
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	body := make(map[string]interface{})
+	body["cpu"] = map[string]interface{}{
+		"usage": state.CPU.Usage,
+		"limit": config.QuotaCPU,
+	}
+	body["memory"] = map[string]interface{}{
+		"usage": state.Memory.Usage,
+		"limit": int64(config.QuotaRAM) * 1000 * 1000,
+	}
+	body["disk"] = map[string]interface{}{
+		"usage": state.Disk["root"].Usage,
+		"limit": int64(config.QuotaDisk) * 1000 * 1000 * 1000,
+	}
+	body["processes"] = map[string]interface{}{
+		"usage": state.Processes,
+		"limit": config.QuotaProcesses,
+	}
+	body["network"] = map[string]interface{}{
+		"bytes_received": bytesReceived,
+		"bytes_sent":     bytesSent,
+	}
+	body["expiry"] = containerExpiry
+	body["remaining"] = remaining
+
+	// Return to the client
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"time"
+
 	"github.com/lxc/lxd/client"
+	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/api"
 )
 
@@ -24,3 +30,88 @@ func lxdForceDelete(d lxd.ContainerServer, name string) error {
 
 	return op.Wait()
 }
+
+// lxdContainerHasIP checks whether the container still holds the global
+// address it was given.
+func lxdContainerHasIP(d lxd.ContainerServer, name string, ip string) (bool, error) {
+	state, _, err := d.GetContainerState(name)
+	if err != nil {
+		return false, err
+	}
+
+	for netName, net := range state.Network {
+		if !shared.StringInSlice(netName, []string{"eth0", "lxcbr0"}) {
+			continue
+		}
+
+		for _, addr := range net.Addresses {
+			if addr.Scope == "global" && addr.Address == ip {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+type lxdExecBuffer struct {
+	bytes.Buffer
+}
+
+func (b *lxdExecBuffer) Close() error {
+	return nil
+}
+
+// lxdExec runs a non-interactive command in the container, returning its
+// exit code and output. It gives up after the timeout unless that's 0.
+func lxdExec(d lxd.ContainerServer, name string, command []string, env map[string]string, timeout time.Duration) (int, string, error) {
+	var stdout lxdExecBuffer
+	var stderr lxdExecBuffer
+
+	req := api.ContainerExecPost{
+		Command:     command,
+		WaitForWS:   true,
+		Environment: env,
+	}
+
+	execArgs := lxd.ContainerExecArgs{
+		Stdin:    ioutil.NopCloser(bytes.NewReader(nil)),
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		DataDone: make(chan bool),
+	}
+
+	op, err := d.ExecContainer(name, req, &execArgs)
+	if err != nil {
+		return -1, "", err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- op.Wait()
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+
+	select {
+	case err = <-done:
+		if err != nil {
+			return -1, "", err
+		}
+	case <-expired:
+		op.Cancel()
+		return -1, "", fmt.Errorf("Command timed out after %s", timeout)
+	}
+
+	<-execArgs.DataDone
+
+	status, ok := op.Get().Metadata["return"].(float64)
+	if !ok {
+		return -1, "", fmt.Errorf("Missing command exit code")
+	}
+
+	return int(status), stdout.String() + stderr.String(), nil
+}
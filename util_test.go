@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/lxc/lxd/client"
+	"github.com/lxc/lxd/shared/api"
+)
+
+// lxdTestServer stands in for LXD, only implementing what the tests use.
+type lxdTestServer struct {
+	lxd.ContainerServer
+
+	lock      sync.Mutex
+	addresses map[string][]string
+	deleted   []string
+	files     map[string]lxd.ContainerFileArgs
+}
+
+type lxdTestOperation struct {
+	lxd.Operation
+}
+
+func (op *lxdTestOperation) Wait() error {
+	return nil
+}
+
+func (s *lxdTestServer) GetContainerState(name string) (*api.ContainerState, string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	addresses := []api.ContainerStateNetworkAddress{{Family: "inet6", Address: "fe80::1", Scope: "link"}}
+	for _, address := range s.addresses[name] {
+		addresses = append(addresses, api.ContainerStateNetworkAddress{Family: "inet", Address: address, Scope: "global"})
+	}
+
+	return &api.ContainerState{Network: map[string]api.ContainerStateNetwork{"eth0": {Addresses: addresses}}}, "", nil
+}
+
+func (s *lxdTestServer) UpdateContainerState(name string, state api.ContainerStatePut, ETag string) (lxd.Operation, error) {
+	return &lxdTestOperation{}, nil
+}
+
+func (s *lxdTestServer) DeleteContainer(name string) (lxd.Operation, error) {
+	s.lock.Lock()
+	s.deleted = append(s.deleted, name)
+	s.lock.Unlock()
+
+	return &lxdTestOperation{}, nil
+}
+
+func (s *lxdTestServer) CreateContainerFile(containerName string, path string, args lxd.ContainerFileArgs) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.files == nil {
+		s.files = map[string]lxd.ContainerFileArgs{}
+	}
+
+	s.files[containerName+path] = args
+	return nil
+}
+
+func TestLxdContainerHasIP(t *testing.T) {
+	d := &lxdTestServer{addresses: map[string][]string{"tryit-1": {"10.0.0.1", "10.0.0.2"}}}
+
+	tests := []struct {
+		ip    string
+		valid bool
+	}{
+		{"10.0.0.1", true},
+		{"10.0.0.2", true},
+		{"10.0.0.3", false},
+		{"fe80::1", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		valid, err := lxdContainerHasIP(d, "tryit-1", test.ip)
+		if err != nil || valid != test.valid {
+			t.Errorf("lxdContainerHasIP(%q) = %v, %v", test.ip, valid, err)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type workshopPost struct {
+	Capacity    int    `json:"capacity"`
+	Environment string `json:"environment"`
+	Start       int64  `json:"start"`
+	End         int64  `json:"end"`
+}
+
+// workshopCheck validates a workshop join code, returning its id,
+// environment, capacity and end date, the id being 0 if it can't be
+// joined now.
+func workshopCheck(code string) (int64, string, int, int64, error) {
+	id, _, environment, capacity, start, end, ended, err := db.GetWorkshop(strings.ToUpper(code))
+	if err != nil {
+		return 0, "", 0, 0, err
+	}
+
+	now := time.Now().Unix()
+	if id == 0 || ended || now < start || now >= end {
+		return 0, "", 0, 0, nil
+	}
+
+	return id, environment, capacity, end, nil
+}
+
+func restWorkshopsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if !restAdminAuth(w, r) {
+		return
+	}
+
+	req := workshopPost{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request", 400)
+		return
+	}
+
+	if req.Start == 0 {
+		req.Start = time.Now().Unix()
+	}
+
+	if req.Capacity <= 0 || req.End <= req.Start || req.End <= time.Now().Unix() {
+		http.Error(w, "Invalid workshop capacity or time window", 400)
+		return
+	}
+
+	_, err = configEnvironment(req.Environment)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid environment: %s", req.Environment), 400)
+		return
+	}
+
+	// Check that the slots can be reserved
+	available, err := reservationCapacity(req.Start, req.End, req.Capacity)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	if !available {
+		http.Error(w, "Not enough capacity for this time window", 409)
+		return
+	}
+
+	secret, err := randomHex(16)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	code, err := credentialsUnusedCode(func(code string) (int64, error) {
+		id, _, _, _, _, _, _, err := db.GetWorkshop(code)
+		return id, err
+	})
+	if err != nil {
+		fmt.Printf("Unable to generate a join code: %s\n", err)
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	err = db.NewWorkshop(code, tokenHash(secret), req.Environment, req.Capacity, req.Start, req.End)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	// The secret isn't stored, this is the only time the instructor gets it
+	body := make(map[string]interface{})
+	body["code"] = code
+	body["secret"] = secret
+
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
+
+func restWorkshopHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get the workshop
+	code := strings.ToUpper(r.FormValue("code"))
+	if code == "" {
+		http.Error(w, "Missing workshop code", 400)
+		return
+	}
+
+	id, secretHash, environment, capacity, start, end, ended, err := db.GetWorkshop(code)
+	if err != nil || id == 0 {
+		http.Error(w, "Workshop not found", 404)
+		return
+	}
+
+	// Check the instructor secret
+	if subtle.ConstantTimeCompare([]byte(tokenHash(r.FormValue("secret"))), []byte(secretHash)) != 1 {
+		http.Error(w, "Invalid workshop secret", 401)
+		return
+	}
+
+	sessions, err := db.GetWorkshopSessions(id)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		attendees := []map[string]interface{}{}
+		for _, entry := range sessions {
+			attendees = append(attendees, map[string]interface{}{
+				"id":           entry[1],
+				"container":    entry[2],
+				"status":       entry[3],
+				"request_date": entry[4],
+				"expiry":       entry[5],
+			})
+		}
+
+		body := make(map[string]interface{})
+		body["code"] = code
+		body["environment"] = environment
+		body["capacity"] = capacity
+		body["start"] = start
+		body["end"] = end
+		body["ended"] = ended
+		body["sessions"] = attendees
+
+		err = json.NewEncoder(w).Encode(body)
+		if err != nil {
+			http.Error(w, "Internal server error", 500)
+			return
+		}
+	case "DELETE":
+		// End the workshop along with all its sessions
+		err = db.EndWorkshop(id)
+		if err != nil {
+			http.Error(w, "Internal server error", 500)
+			return
+		}
+
+		for _, entry := range sessions {
+			if entry[3].(int) != 0 {
+				continue
+			}
+
+			containerName := entry[2].(string)
+			lxdForceDelete(lxdDaemon, containerName)
+			proxyForget(containerName)
+			db.Expire(int64(entry[0].(int)))
+		}
+	default:
+		http.Error(w, "Not implemented", 501)
+	}
+}
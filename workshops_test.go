@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWorkshop(t *testing.T) {
+	defer dbTestGlobal(t)()
+
+	config = serverConfig{ServerAdminKeys: []string{"admin"}, ServerContainersMax: 10}
+
+	// Create the workshop
+	body := fmt.Sprintf(`{"capacity": 5, "end": %d}`, time.Now().Add(time.Hour).Unix())
+	rec := httptest.NewRecorder()
+	restWorkshopsHandler(rec, httptest.NewRequest("POST", "/1.0/workshops?key=admin", strings.NewReader(body)))
+
+	if rec.Code != 200 {
+		t.Fatalf("POST /1.0/workshops returned %d: %s", rec.Code, rec.Body.String())
+	}
+
+	created := map[string]string{}
+	err := json.NewDecoder(rec.Body).Decode(&created)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Look it up as the instructor
+	tests := []struct {
+		name   string
+		code   string
+		secret string
+		status int
+	}{
+		{"valid", created["code"], created["secret"], 200},
+		{"lowercase code", strings.ToLower(created["code"]), created["secret"], 200},
+		{"wrong secret", created["code"], "forged", 401},
+		{"unknown code", "ZZZZZZ", created["secret"], 404},
+		{"no code", "", created["secret"], 400},
+	}
+
+	for _, test := range tests {
+		query := url.Values{"code": {test.code}, "secret": {test.secret}}
+		rec = httptest.NewRecorder()
+		restWorkshopHandler(rec, httptest.NewRequest("GET", "/1.0/workshop?"+query.Encode(), nil))
+
+		if rec.Code != test.status {
+			t.Errorf("%s: got status %d, want %d: %s", test.name, rec.Code, test.status, rec.Body.String())
+		}
+	}
+
+	// The capacity is reserved
+	body = fmt.Sprintf(`{"capacity": 6, "end": %d}`, time.Now().Add(time.Hour).Unix())
+	rec = httptest.NewRecorder()
+	restWorkshopsHandler(rec, httptest.NewRequest("POST", "/1.0/workshops?key=admin", strings.NewReader(body)))
+
+	if rec.Code != 409 {
+		t.Errorf("POST /1.0/workshops over capacity returned %d", rec.Code)
+	}
+
+	// Database errors aren't passed on to the client
+	_, err = db.(*dbSqlite).conn.Exec("ALTER TABLE workshops RENAME COLUMN code TO broken;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body = fmt.Sprintf(`{"capacity": 1, "end": %d}`, time.Now().Add(time.Hour).Unix())
+	rec = httptest.NewRecorder()
+	restWorkshopsHandler(rec, httptest.NewRequest("POST", "/1.0/workshops?key=admin", strings.NewReader(body)))
+
+	if rec.Code != 500 || strings.TrimSpace(rec.Body.String()) != "Internal server error" {
+		t.Errorf("POST /1.0/workshops with a failing code lookup returned %d: %s", rec.Code, rec.Body.String())
+	}
+}